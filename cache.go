@@ -0,0 +1,763 @@
+// Copyright © 2018-2019 Luis Ángel Méndez Gort
+
+// This file is part of Proxy.
+
+// Proxy is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General
+// Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your
+// option) any later version.
+
+// Proxy is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the
+// implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU Lesser General Public
+// License for more details.
+
+// You should have received a copy of the GNU Lesser General
+// Public License along with Proxy.  If not, see
+// <https://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	h "net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache is a shared HTTP cache (RFC 9111) for the responses to
+// plain HTTP requests, stored in memory and optionally in a
+// directory, when they don't fit in the former
+type Cache struct {
+	// Policy decides whether the client of a request can get a
+	// stored response, like the Dialer does for the requests
+	// sent. The Proxy doesn't use a Cache without it
+	Policy func(*ReqParams) error
+	// MaxObject is the size of the biggest response body
+	// stored, DefaultMaxObject when 0. Without directory it's
+	// at most the memory size
+	MaxObject int64
+
+	mem  *memoryTier
+	disk *diskTier
+	// mtx serializes the access to the tiers. The files of the
+	// disk tier are read and written without holding it
+	mtx sync.Mutex
+	// pending has the objects being written to disk
+	pending map[string]*cacheObject
+	now     func() time.Time
+}
+
+// DefaultMaxObject is the MaxObject of a Cache when not set
+const DefaultMaxObject = 4 << 20
+
+// spoolSize is the size of a response body kept in memory
+// while storing it. Bigger bodies are written to a file in the
+// cache directory, when there's one
+const spoolSize = 1 << 20
+
+// Cache statuses, reported in the X-Cache header
+const (
+	CacheHit         = "HIT"
+	CacheMiss        = "MISS"
+	CacheRevalidated = "REVALIDATED"
+)
+
+// NewCache creates a cache storing up to memSize bytes in
+// memory, and diskSize bytes in dir when it isn't empty. The
+// objects in dir from previous executions are kept
+func NewCache(memSize int64, dir string,
+	diskSize int64) (c *Cache, e error) {
+	c = &Cache{
+		mem:     newMemoryTier(memSize),
+		pending: make(map[string]*cacheObject),
+	}
+	if dir != "" {
+		c.disk, e = newDiskTier(dir, diskSize)
+	}
+	if e != nil {
+		c = nil
+	}
+	return
+}
+
+// maxObject returns the size of the biggest body stored
+func (c *Cache) maxObject() (n int64) {
+	n = c.MaxObject
+	if n == 0 {
+		n = DefaultMaxObject
+	}
+	if c.disk == nil && n > c.mem.max {
+		n = c.mem.max
+	}
+	return
+}
+
+func (c *Cache) time() (t time.Time) {
+	if c.now != nil {
+		t = c.now()
+	} else {
+		t = time.Now()
+	}
+	return
+}
+
+// cacheEntry is a stored response
+type cacheEntry struct {
+	Status int
+	Header h.Header
+	Body   []byte
+	// Offset and Length locate the body in the file at path,
+	// when it's there instead of in Body
+	Offset, Length int64
+	// Vary has the values of the request headers named in the
+	// Vary response header
+	Vary h.Header
+	// ReqTime and RespTime are the times when the request that
+	// obtained the response was sent, and the response received
+	ReqTime, RespTime time.Time
+	// path, when not empty, is the file with the body. spooled
+	// means it's a temporary one, with a body just received
+	path    string
+	spooled bool
+}
+
+// cacheObject has the entries stored for a URL, one for each
+// variant
+type cacheObject struct {
+	Key      string
+	Variants []*cacheEntry
+}
+
+func (o *cacheObject) size() (n int64) {
+	for _, v := range o.Variants {
+		n += v.length()
+		for k, vs := range v.Header {
+			n += int64(len(k) + len(strings.Join(vs, "")))
+		}
+	}
+	return
+}
+
+// inMemory returns whether the bodies of o are in memory
+func (o *cacheObject) inMemory() (ok bool) {
+	ok = true
+	for _, v := range o.Variants {
+		ok = ok && v.path == ""
+	}
+	return
+}
+
+// allow returns the error that keeps the client with rqp from
+// getting a stored response
+func (c *Cache) allow(rqp *ReqParams) (e error) {
+	if rqp != nil {
+		e = c.Policy(rqp)
+	}
+	return
+}
+
+// roundTrip answers req from the cache when possible, and
+// otherwise with trans, storing the responses it can. A
+// stored response is sent only when allow returns no error.
+// status is one of the Cache statuses, or empty when req's
+// method isn't cacheable
+func (c *Cache) roundTrip(trans h.RoundTripper, req *h.Request,
+	allow func() error) (resp *h.Response, status string, e error) {
+	key := req.URL.String()
+	if req.Method != h.MethodGet && req.Method != h.MethodHead {
+		resp, e = trans.RoundTrip(req)
+		if e == nil && resp.StatusCode < 400 && !safeMethod(req.Method) {
+			// RFC 9111 section 4.4
+			c.remove(key)
+		}
+		return
+	}
+	status = CacheMiss
+	entry := c.lookup(key, req)
+	reqTime := c.time()
+	fresh := entry != nil && entry.usable(req, reqTime)
+	if fresh {
+		e = allow()
+	}
+	if fresh && e == nil {
+		status = CacheHit
+		if resp, e = entry.response(req, reqTime); e != nil {
+			// its file was removed meanwhile
+			entry, status, e = nil, CacheMiss, nil
+		}
+	}
+	if e == nil && resp == nil && entry != nil && entry.validators() {
+		cond := req.Clone(req.Context())
+		cond.Header.Del("If-Modified-Since")
+		cond.Header.Del("If-None-Match")
+		if etag := entry.Header.Get("Etag"); etag != "" {
+			cond.Header.Set("If-None-Match", etag)
+		}
+		if lm := entry.Header.Get("Last-Modified"); lm != "" {
+			cond.Header.Set("If-Modified-Since", lm)
+		}
+		resp, e = trans.RoundTrip(cond)
+		if e == nil && resp.StatusCode == h.StatusNotModified {
+			resp.Body.Close()
+			now := c.time()
+			entry = entry.revalidated(resp.Header, reqTime, now)
+			c.put(key, entry)
+			resp = nil
+			if e = allow(); e == nil {
+				status = CacheRevalidated
+				resp, e = entry.response(req, now)
+			}
+		} else if e == nil {
+			resp = c.storing(key, req, resp, reqTime)
+		}
+	} else if e == nil && resp == nil {
+		resp, e = trans.RoundTrip(req)
+		if e == nil {
+			resp = c.storing(key, req, resp, reqTime)
+		}
+	}
+	return
+}
+
+func safeMethod(m string) (ok bool) {
+	ok = m == h.MethodGet || m == h.MethodHead ||
+		m == h.MethodOptions || m == h.MethodTrace
+	return
+}
+
+// storing returns resp with a body that stores it when it's
+// read completely, if it can be stored
+func (c *Cache) storing(key string, req *h.Request,
+	resp *h.Response, reqTime time.Time) (r *h.Response) {
+	r = resp
+	if req.Method == h.MethodGet && storable(req, resp) &&
+		resp.ContentLength <= c.maxObject() {
+		entry := &cacheEntry{
+			Status:  resp.StatusCode,
+			Header:  resp.Header.Clone(),
+			Vary:    varyValues(resp.Header, req.Header),
+			ReqTime: reqTime,
+		}
+		b := &cacheBody{
+			ReadCloser: resp.Body,
+			entry:      entry,
+			limit:      c.maxObject(),
+			done: func() {
+				entry.RespTime = c.time()
+				c.put(key, entry)
+			},
+		}
+		if c.disk != nil {
+			b.dir = c.disk.dir
+		}
+		r.Body = b
+	} else if req.Method == h.MethodGet && resp.StatusCode < 400 {
+		// a stored response isn't the latest
+		c.remove(key)
+	}
+	return
+}
+
+// cacheBody reads a response body, calling done after setting
+// it in entry when read completely, unless it exceeds limit.
+// When dir isn't empty, bodies bigger than spoolSize are
+// written to a temporary file there instead of kept in memory
+type cacheBody struct {
+	io.ReadCloser
+	entry *cacheEntry
+	buf   bytes.Buffer
+	spool *os.File
+	n     int64
+	limit int64
+	dir   string
+	done  func()
+}
+
+func (b *cacheBody) Read(p []byte) (n int, e error) {
+	n, e = b.ReadCloser.Read(p)
+	if b.done != nil && n != 0 {
+		b.n += int64(n)
+		if b.n > b.limit || !b.record(p[:n]) {
+			b.discard()
+		}
+	}
+	if e == io.EOF && b.done != nil {
+		b.entry.Length = b.n
+		if b.spool == nil {
+			b.entry.Body = b.buf.Bytes()
+		} else if b.spool.Close() == nil {
+			b.entry.path, b.entry.spooled = b.spool.Name(), true
+		} else {
+			os.Remove(b.spool.Name())
+			b.done = nil
+		}
+		if b.done != nil {
+			b.done()
+			b.done = nil
+		}
+	}
+	if e != nil && e != io.EOF {
+		b.discard()
+	}
+	return
+}
+
+// record keeps p, moving the body to a spool file when it
+// gets bigger than spoolSize. ok is false when writing fails
+func (b *cacheBody) record(p []byte) (ok bool) {
+	var e error
+	if b.spool == nil && b.dir != "" &&
+		b.buf.Len()+len(p) > spoolSize {
+		b.spool, e = ioutil.TempFile(b.dir, "tmp")
+		if e == nil {
+			_, e = b.buf.WriteTo(b.spool)
+		} else {
+			b.spool = nil
+		}
+	}
+	if e == nil && b.spool != nil {
+		_, e = b.spool.Write(p)
+	} else if e == nil {
+		b.buf.Write(p)
+	}
+	ok = e == nil
+	return
+}
+
+// discard stops storing the body
+func (b *cacheBody) discard() {
+	if b.done != nil && b.spool != nil {
+		b.spool.Close()
+		os.Remove(b.spool.Name())
+	}
+	b.done = nil
+	b.buf = bytes.Buffer{}
+}
+
+func (b *cacheBody) Close() (e error) {
+	// an incomplete body isn't stored
+	b.discard()
+	e = b.ReadCloser.Close()
+	return
+}
+
+// lookup returns the stored entry for key matching the
+// Vary header values in req, or nil
+func (c *Cache) lookup(key string, req *h.Request) (entry *cacheEntry) {
+	obj := c.load(key)
+	for i := 0; obj != nil && entry == nil &&
+		i != len(obj.Variants); i++ {
+		v := obj.Variants[i]
+		if varyMatches(v.Vary, req.Header) {
+			entry = v
+		}
+	}
+	return
+}
+
+// put stores entry as the variant of key with its Vary
+// values. The stored objects aren't modified, since they are
+// read without holding mtx
+func (c *Cache) put(key string, entry *cacheEntry) {
+	obj := &cacheObject{Key: key, Variants: []*cacheEntry{entry}}
+	if old := c.load(key); old != nil {
+		for _, v := range old.Variants {
+			if !varyMatches(v.Vary, entry.Vary) {
+				obj.Variants = append(obj.Variants, v)
+			}
+		}
+	}
+	c.store(obj)
+}
+
+func (c *Cache) remove(key string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.mem.del(key)
+	delete(c.pending, key)
+	if c.disk != nil {
+		c.disk.del(key)
+	}
+}
+
+// load returns the object for key. The objects in disk stay
+// there, and are read without holding mtx
+func (c *Cache) load(key string) (obj *cacheObject) {
+	c.mtx.Lock()
+	obj = c.mem.get(key)
+	if obj == nil {
+		obj = c.pending[key]
+	}
+	var name string
+	if obj == nil && c.disk != nil {
+		name = c.disk.lookup(key)
+	}
+	c.mtx.Unlock()
+	if name != "" {
+		var e error
+		obj, e = c.disk.read(name, key)
+		if e != nil {
+			// unreadable
+			c.mtx.Lock()
+			c.disk.del(key)
+			c.mtx.Unlock()
+		}
+	}
+	return
+}
+
+// store keeps obj in memory if it fits, and otherwise in
+// disk. The objects going to disk, including those evicted
+// from memory, are written without holding mtx
+func (c *Cache) store(obj *cacheObject) {
+	size := obj.size()
+	var demoted []*cacheObject
+	c.mtx.Lock()
+	delete(c.pending, obj.Key)
+	if size <= c.mem.max && obj.inMemory() {
+		if c.disk != nil {
+			c.disk.del(obj.Key)
+		}
+		demoted = c.mem.put(obj, size)
+	} else {
+		c.mem.del(obj.Key)
+		demoted = []*cacheObject{obj}
+	}
+	if c.disk == nil {
+		demoted = nil
+	}
+	for _, o := range demoted {
+		c.pending[o.Key] = o
+	}
+	c.mtx.Unlock()
+	for _, o := range demoted {
+		c.demote(o)
+	}
+}
+
+// demote writes obj in disk, unless it was replaced or
+// removed meanwhile. The spool files of its bodies are removed
+// afterwards
+func (c *Cache) demote(obj *cacheObject) {
+	tmp, size, e := c.disk.write(obj)
+	c.mtx.Lock()
+	current := c.pending[obj.Key] == obj
+	if current {
+		delete(c.pending, obj.Key)
+	}
+	if e == nil && current {
+		c.disk.commit(obj.Key, tmp, size)
+	} else if e == nil {
+		os.Remove(tmp)
+	}
+	c.mtx.Unlock()
+	for _, v := range obj.Variants {
+		if v.spooled {
+			os.Remove(v.path)
+		}
+	}
+}
+
+// cacheableByDefault are the status codes of responses that
+// can get heuristic freshness (RFC 9110 section 15.1)
+var cacheableByDefault = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true,
+	308: true, 404: true, 405: true, 410: true, 414: true,
+	501: true,
+}
+
+// storable returns whether a shared cache can store resp, the
+// response to req (RFC 9111 section 3)
+func storable(req *h.Request, resp *h.Response) (ok bool) {
+	rcc, cc := parseCacheControl(req.Header["Cache-Control"]),
+		parseCacheControl(resp.Header["Cache-Control"])
+	_, sMaxAge := cc["s-maxage"]
+	_, maxAge := cc["max-age"]
+	explicit := sMaxAge || maxAge || resp.Header.Get("Expires") != ""
+	_, authorized := req.Header["Authorization"]
+	ok = (cacheableByDefault[resp.StatusCode] ||
+		explicit && (resp.StatusCode == h.StatusFound ||
+			resp.StatusCode == h.StatusTemporaryRedirect)) &&
+		!rcc.has("no-store") && !cc.has("no-store") &&
+		!cc.has("private") &&
+		(!authorized || cc.has("public") || sMaxAge ||
+			cc.has("must-revalidate")) &&
+		resp.Header.Get("Vary") != "*"
+	e := &cacheEntry{Status: resp.StatusCode, Header: resp.Header}
+	ok = ok && (explicit || e.validators() ||
+		e.lifetime() != 0)
+	return
+}
+
+// varyValues returns the values in reqHd of the headers named
+// in the Vary header of respHd
+func varyValues(respHd, reqHd h.Header) (vary h.Header) {
+	vary = make(h.Header)
+	for _, v := range respHd["Vary"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				k := h.CanonicalHeaderKey(name)
+				vary[k] = []string{normalizedValue(reqHd[k])}
+			}
+		}
+	}
+	return
+}
+
+// varyMatches returns whether the stored Vary values match
+// those in hd
+func varyMatches(vary, hd h.Header) (ok bool) {
+	ok = true
+	for k, vs := range vary {
+		ok = ok && vs[0] == normalizedValue(hd[k])
+	}
+	return
+}
+
+func normalizedValue(vs []string) (v string) {
+	ts := strings.Split(strings.Join(vs, ","), ",")
+	for i := range ts {
+		ts[i] = strings.TrimSpace(ts[i])
+	}
+	v = strings.Join(ts, ",")
+	return
+}
+
+// usable returns whether e can be sent as response to req at
+// now without revalidation (RFC 9111 section 4.2)
+func (e *cacheEntry) usable(req *h.Request, now time.Time) (ok bool) {
+	rcc := parseCacheControl(req.Header["Cache-Control"])
+	if len(rcc) == 0 && hasToken(req.Header.Get("Pragma"),
+		"no-cache") {
+		rcc["no-cache"] = ""
+	}
+	cc := parseCacheControl(e.Header["Cache-Control"])
+	age, lifetime := e.age(now), e.lifetime()
+	ok = !cc.has("no-cache") && !rcc.has("no-cache")
+	if maxAge, has := rcc.seconds("max-age"); has {
+		ok = ok && age <= maxAge
+	}
+	if minFresh, has := rcc.seconds("min-fresh"); has {
+		ok = ok && lifetime-age >= minFresh
+	}
+	if ok && age >= lifetime {
+		// stale, usable only if the client accepts it and the
+		// origin allows it
+		maxStale, has := rcc.seconds("max-stale")
+		_, sMaxAge := cc["s-maxage"]
+		ok = rcc.has("max-stale") && !cc.has("must-revalidate") &&
+			!cc.has("proxy-revalidate") && !sMaxAge &&
+			(!has || age-lifetime <= maxStale)
+	}
+	return
+}
+
+// lifetime returns the freshness lifetime of e (RFC 9111
+// section 4.2.1)
+func (e *cacheEntry) lifetime() (d time.Duration) {
+	cc := parseCacheControl(e.Header["Cache-Control"])
+	date := e.date()
+	if s, ok := cc.seconds("s-maxage"); ok {
+		d = s
+	} else if s, ok := cc.seconds("max-age"); ok {
+		d = s
+	} else if exp := e.Header.Get("Expires"); exp != "" {
+		// invalid dates mean already expired
+		if t, err := h.ParseTime(exp); err == nil && t.After(date) {
+			d = t.Sub(date)
+		}
+	} else if lm, err := h.ParseTime(e.Header.Get(
+		"Last-Modified")); err == nil && cacheableByDefault[e.Status] &&
+		date.After(lm) {
+		// heuristic freshness, 10% of the time since modified
+		d = date.Sub(lm) / 10
+		if d > 24*time.Hour {
+			d = 24 * time.Hour
+		}
+	}
+	return
+}
+
+// date returns the Date of e, or RespTime when missing
+func (e *cacheEntry) date() (t time.Time) {
+	var err error
+	t, err = h.ParseTime(e.Header.Get("Date"))
+	if err != nil {
+		t = e.RespTime
+	}
+	return
+}
+
+// age returns the current age of e (RFC 9111 section 4.2.3)
+func (e *cacheEntry) age(now time.Time) (d time.Duration) {
+	apparent := e.RespTime.Sub(e.date())
+	if apparent < 0 {
+		apparent = 0
+	}
+	ageValue, _ := strconv.Atoi(e.Header.Get("Age"))
+	corrected := time.Duration(ageValue)*time.Second +
+		e.RespTime.Sub(e.ReqTime)
+	d = apparent
+	if corrected > d {
+		d = corrected
+	}
+	d += now.Sub(e.RespTime)
+	return
+}
+
+func (e *cacheEntry) validators() (ok bool) {
+	ok = e.Header.Get("Etag") != "" ||
+		e.Header.Get("Last-Modified") != ""
+	return
+}
+
+// revalidated returns a copy of e updated with the headers of
+// a 304 response (RFC 9111 section 3.2)
+func (e *cacheEntry) revalidated(hd h.Header, reqTime,
+	respTime time.Time) (r *cacheEntry) {
+	r = &cacheEntry{
+		Status:   e.Status,
+		Header:   e.Header.Clone(),
+		Body:     e.Body,
+		Offset:   e.Offset,
+		Length:   e.Length,
+		Vary:     e.Vary,
+		ReqTime:  reqTime,
+		RespTime: respTime,
+		path:     e.path,
+		spooled:  e.spooled,
+	}
+	for k, vs := range hd {
+		if k != "Content-Length" {
+			r.Header[k] = vs
+		}
+	}
+	return
+}
+
+// length returns the size of the body of e
+func (e *cacheEntry) length() (n int64) {
+	n = e.Length
+	if e.path == "" {
+		n = int64(len(e.Body))
+	}
+	return
+}
+
+// body returns a reader of the body of e, from its file when
+// it's there
+func (e *cacheEntry) body() (r io.ReadCloser, err error) {
+	if e.path == "" {
+		r = ioutil.NopCloser(bytes.NewReader(e.Body))
+		return
+	}
+	var f *os.File
+	f, err = os.Open(e.path)
+	if err == nil {
+		r = &fileSection{
+			SectionReader: io.NewSectionReader(f, e.Offset, e.Length),
+			f:             f,
+		}
+	}
+	return
+}
+
+// fileSection reads a part of a file, closing it afterwards
+type fileSection struct {
+	*io.SectionReader
+	f *os.File
+}
+
+func (s *fileSection) Close() (e error) {
+	e = s.f.Close()
+	return
+}
+
+// response returns e as response to req at now. It is 304 when
+// req is conditional on e's ETag. err is not nil when the file
+// with the body can't be opened
+func (e *cacheEntry) response(req *h.Request,
+	now time.Time) (resp *h.Response, err error) {
+	n := e.length()
+	resp = &h.Response{
+		StatusCode:    e.Status,
+		Status:        strconv.Itoa(e.Status) + " " + h.StatusText(e.Status),
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        e.Header.Clone(),
+		Body:          h.NoBody,
+		ContentLength: n,
+		Request:       req,
+	}
+	resp.Header.Set("Age", strconv.Itoa(int(e.age(now).Seconds())))
+	resp.Header.Set("Content-Length", strconv.FormatInt(n, 10))
+	inm, etag := req.Header.Get("If-None-Match"), e.Header.Get("Etag")
+	notModified := etag != "" && e.Status == h.StatusOK &&
+		(strings.TrimSpace(inm) == "*" || hasToken(inm, etag))
+	if notModified {
+		resp.StatusCode = h.StatusNotModified
+		resp.Status = "304 " + h.StatusText(h.StatusNotModified)
+		resp.Header.Del("Content-Length")
+	}
+	if notModified || req.Method == h.MethodHead {
+		resp.ContentLength = 0
+	} else {
+		resp.Body, err = e.body()
+	}
+	if err != nil {
+		resp = nil
+	}
+	return
+}
+
+// cacheControl has the directives of Cache-Control headers,
+// with their unquoted arguments
+type cacheControl map[string]string
+
+func parseCacheControl(vs []string) (cc cacheControl) {
+	cc = make(cacheControl)
+	for _, v := range vs {
+		for _, d := range splitQuoted(v, ',') {
+			name, arg := strings.TrimSpace(d), ""
+			if i := strings.IndexByte(name, '='); i != -1 {
+				name, arg = strings.TrimSpace(name[:i]),
+					strings.TrimSpace(name[i+1:])
+				if len(arg) >= 2 && arg[0] == '"' &&
+					arg[len(arg)-1] == '"' {
+					arg = unquote(arg[1 : len(arg)-1])
+				}
+			}
+			if name != "" {
+				cc[strings.ToLower(name)] = arg
+			}
+		}
+	}
+	return
+}
+
+func (cc cacheControl) has(d string) (ok bool) {
+	_, ok = cc[d]
+	return
+}
+
+// seconds returns the argument of d as a duration, and
+// whether it's a valid one
+func (cc cacheControl) seconds(d string) (t time.Duration,
+	ok bool) {
+	var arg string
+	if arg, ok = cc[d]; ok {
+		s, err := strconv.ParseInt(arg, 10, 64)
+		ok = err == nil && s >= 0
+		t = time.Duration(s) * time.Second
+	}
+	return
+}
@@ -0,0 +1,299 @@
+// Copyright © 2018-2019 Luis Ángel Méndez Gort
+
+// This file is part of Proxy.
+
+// Proxy is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General
+// Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your
+// option) any later version.
+
+// Proxy is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the
+// implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU Lesser General Public
+// License for more details.
+
+// You should have received a copy of the GNU Lesser General
+// Public License along with Proxy.  If not, see
+// <https://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// memoryTier keeps cache objects in memory, evicting the
+// least recently used when exceeding max bytes
+type memoryTier struct {
+	max, size int64
+	lru       *list.List
+	items     map[string]*list.Element
+}
+
+type memoryItem struct {
+	obj  *cacheObject
+	size int64
+}
+
+func newMemoryTier(max int64) (m *memoryTier) {
+	m = &memoryTier{
+		max:   max,
+		lru:   list.New(),
+		items: make(map[string]*list.Element),
+	}
+	return
+}
+
+func (m *memoryTier) get(key string) (obj *cacheObject) {
+	if el, ok := m.items[key]; ok {
+		m.lru.MoveToFront(el)
+		obj = el.Value.(*memoryItem).obj
+	}
+	return
+}
+
+// put stores obj, returning the objects evicted for making
+// room for it
+func (m *memoryTier) put(obj *cacheObject,
+	size int64) (evicted []*cacheObject) {
+	m.del(obj.Key)
+	m.items[obj.Key] = m.lru.PushFront(&memoryItem{obj: obj, size: size})
+	m.size += size
+	for m.size > m.max {
+		back := m.lru.Back()
+		it := back.Value.(*memoryItem)
+		m.remove(back)
+		evicted = append(evicted, it.obj)
+	}
+	return
+}
+
+func (m *memoryTier) del(key string) {
+	if el, ok := m.items[key]; ok {
+		m.remove(el)
+	}
+}
+
+func (m *memoryTier) remove(el *list.Element) {
+	it := m.lru.Remove(el).(*memoryItem)
+	delete(m.items, it.obj.Key)
+	m.size -= it.size
+}
+
+// diskTier keeps cache objects in files of a directory,
+// named by the SHA-256 of their keys and a random suffix,
+// evicting the least recently used when exceeding max bytes.
+// A file has the length of the gob encoded object, the object
+// without its bodies, and the bodies. Files aren't modified,
+// but replaced by new ones, so the bodies can be read while
+// the object changes
+type diskTier struct {
+	dir       string
+	max, size int64
+	lru       *list.List
+	// items has the elements of lru, whose values are
+	// *diskItem, by hash of the key
+	items map[string]*list.Element
+}
+
+type diskItem struct {
+	hash, name string
+	size       int64
+}
+
+// newDiskTier creates dir if needed, and indexes the files in
+// it by modification time. The temporary files left by a
+// previous execution are removed
+func newDiskTier(dir string, max int64) (d *diskTier, e error) {
+	d = &diskTier{
+		dir:   dir,
+		max:   max,
+		lru:   list.New(),
+		items: make(map[string]*list.Element),
+	}
+	e = os.MkdirAll(dir, 0700)
+	var fs []os.FileInfo
+	if e == nil {
+		fs, e = ioutil.ReadDir(dir)
+	}
+	sort.Slice(fs, func(i, j int) bool {
+		return fs[i].ModTime().Before(fs[j].ModTime())
+	})
+	n := sha256.Size * 2
+	for _, f := range fs {
+		name, regular := f.Name(), f.Mode().IsRegular()
+		if regular && len(name) == n+1+diskSuffix*2 && name[n] == '-' {
+			// the newest file of a hash replaces the others
+			if el, ok := d.items[name[:n]]; ok {
+				d.remove(el)
+			}
+			d.add(name[:n], name, f.Size())
+		} else if regular && strings.HasPrefix(name, "tmp") {
+			os.Remove(filepath.Join(dir, name))
+		}
+	}
+	if e == nil {
+		d.evict()
+	}
+	return
+}
+
+// diskSuffix is the number of random bytes in the name of
+// a file, after the hash
+const diskSuffix = 8
+
+func diskHash(key string) (hash string) {
+	sum := sha256.Sum256([]byte(key))
+	hash = hex.EncodeToString(sum[:])
+	return
+}
+
+// lookup returns the name of the file with the object for
+// key, or an empty string
+func (d *diskTier) lookup(key string) (name string) {
+	if el, ok := d.items[diskHash(key)]; ok {
+		d.lru.MoveToFront(el)
+		name = el.Value.(*diskItem).name
+	}
+	return
+}
+
+// read decodes the object for key in the file name, whose
+// entries get their bodies from it. obj is nil when the file
+// has the one of another key, with the same hash. It doesn't
+// access the index, for calling it without holding the lock
+// of the cache
+func (d *diskTier) read(name, key string) (obj *cacheObject,
+	e error) {
+	path := filepath.Join(d.dir, name)
+	var f *os.File
+	f, e = os.Open(path)
+	var n uint64
+	if e == nil {
+		br := bufio.NewReader(f)
+		e = binary.Read(br, binary.BigEndian, &n)
+		if e == nil {
+			obj = new(cacheObject)
+			e = gob.NewDecoder(io.LimitReader(br, int64(n))).Decode(obj)
+		}
+		f.Close()
+	}
+	if e != nil || obj.Key != key {
+		obj = nil
+	} else {
+		for _, v := range obj.Variants {
+			v.path, v.Offset = path, v.Offset+8+int64(n)
+		}
+	}
+	return
+}
+
+// write stores obj in a temporary file, made part of the tier
+// by commit, for not leaving incomplete objects. Like read, it
+// doesn't access the index
+func (d *diskTier) write(obj *cacheObject) (tmp string,
+	size int64, e error) {
+	// the offsets of the bodies are relative to the end of
+	// the object
+	meta := &cacheObject{Key: obj.Key}
+	var offset int64
+	for _, v := range obj.Variants {
+		m := *v
+		m.Body, m.Offset, m.Length = nil, offset, v.length()
+		offset += m.Length
+		meta.Variants = append(meta.Variants, &m)
+	}
+	buf := bytes.NewBuffer(make([]byte, 8))
+	e = gob.NewEncoder(buf).Encode(meta)
+	var f *os.File
+	if e == nil {
+		binary.BigEndian.PutUint64(buf.Bytes(), uint64(buf.Len()-8))
+		f, e = ioutil.TempFile(d.dir, "tmp")
+	}
+	if e == nil {
+		tmp = f.Name()
+		_, e = buf.WriteTo(f)
+		for i := 0; e == nil && i != len(obj.Variants); i++ {
+			v := obj.Variants[i]
+			var r io.ReadCloser
+			if r, e = v.body(); e == nil {
+				_, e = io.CopyN(f, r, v.length())
+				r.Close()
+			}
+		}
+		var fi os.FileInfo
+		if e == nil {
+			fi, e = f.Stat()
+		}
+		if ce := f.Close(); e == nil {
+			e = ce
+		}
+		if e == nil {
+			size = fi.Size()
+		} else {
+			os.Remove(tmp)
+		}
+	}
+	return
+}
+
+// commit renames tmp, written by write, as the file for key
+func (d *diskTier) commit(key, tmp string, size int64) {
+	hash := diskHash(key)
+	suffix := make([]byte, diskSuffix)
+	_, e := rand.Read(suffix)
+	name := hash + "-" + hex.EncodeToString(suffix)
+	if e == nil {
+		e = os.Rename(tmp, filepath.Join(d.dir, name))
+	}
+	if e == nil {
+		d.del(key)
+		d.add(hash, name, size)
+		d.evict()
+	} else {
+		os.Remove(tmp)
+	}
+}
+
+func (d *diskTier) add(hash, name string, size int64) {
+	d.items[hash] = d.lru.PushFront(&diskItem{
+		hash: hash,
+		name: name,
+		size: size,
+	})
+	d.size += size
+}
+
+func (d *diskTier) evict() {
+	for d.size > d.max {
+		d.remove(d.lru.Back())
+	}
+}
+
+func (d *diskTier) del(key string) {
+	if el, ok := d.items[diskHash(key)]; ok {
+		d.remove(el)
+	}
+}
+
+func (d *diskTier) remove(el *list.Element) {
+	it := d.lru.Remove(el).(*diskItem)
+	delete(d.items, it.hash)
+	d.size -= it.size
+	os.Remove(filepath.Join(d.dir, it.name))
+}
@@ -0,0 +1,440 @@
+// Copyright © 2018-2019 Luis Ángel Méndez Gort
+
+// This file is part of Proxy.
+
+// Proxy is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General
+// Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your
+// option) any later version.
+
+// Proxy is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the
+// implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU Lesser General Public
+// License for more details.
+
+// You should have received a copy of the GNU Lesser General
+// Public License along with Proxy.  If not, see
+// <https://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	h "net/http"
+	ht "net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheFreshness(t *testing.T) {
+	now := time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)
+	date := now.Format(h.TimeFormat)
+	ts := []struct {
+		hd       h.Header
+		status   int
+		reqCC    string
+		age      time.Duration
+		lifetime time.Duration
+		usable   bool
+	}{
+		{
+			hd:       h.Header{"Cache-Control": {"max-age=60"}},
+			status:   200,
+			age:      10 * time.Second,
+			lifetime: time.Minute,
+			usable:   true,
+		},
+		{
+			hd:       h.Header{"Cache-Control": {"max-age=60, s-maxage=5"}},
+			status:   200,
+			age:      10 * time.Second,
+			lifetime: 5 * time.Second,
+		},
+		{
+			hd: h.Header{
+				"Date":    {date},
+				"Expires": {now.Add(time.Hour).Format(h.TimeFormat)},
+			},
+			status:   200,
+			lifetime: time.Hour,
+			usable:   true,
+		},
+		{
+			hd:     h.Header{"Date": {date}, "Expires": {"0"}},
+			status: 200,
+		},
+		{
+			hd: h.Header{
+				"Date":          {date},
+				"Last-Modified": {now.Add(-10 * time.Hour).Format(h.TimeFormat)},
+			},
+			status:   200,
+			lifetime: time.Hour,
+			usable:   true,
+		},
+		{
+			// heuristics don't apply to this status
+			hd: h.Header{
+				"Date":          {date},
+				"Last-Modified": {now.Add(-10 * time.Hour).Format(h.TimeFormat)},
+			},
+			status: 302,
+		},
+		{
+			hd:       h.Header{"Cache-Control": {"max-age=60, no-cache"}},
+			status:   200,
+			lifetime: time.Minute,
+		},
+		{
+			hd:       h.Header{"Cache-Control": {"max-age=60"}},
+			status:   200,
+			reqCC:    "max-age=5",
+			age:      10 * time.Second,
+			lifetime: time.Minute,
+		},
+		{
+			hd:       h.Header{"Cache-Control": {"max-age=60"}},
+			status:   200,
+			reqCC:    "min-fresh=55",
+			age:      10 * time.Second,
+			lifetime: time.Minute,
+		},
+		{
+			hd:       h.Header{"Cache-Control": {"max-age=60"}},
+			status:   200,
+			reqCC:    "max-stale=30",
+			age:      80 * time.Second,
+			lifetime: time.Minute,
+			usable:   true,
+		},
+		{
+			hd:       h.Header{"Cache-Control": {"max-age=60, must-revalidate"}},
+			status:   200,
+			reqCC:    "max-stale",
+			age:      80 * time.Second,
+			lifetime: time.Minute,
+		},
+		{
+			// the Age header counts
+			hd: h.Header{"Cache-Control": {"max-age=60"},
+				"Age": {"55"}},
+			status:   200,
+			age:      65 * time.Second,
+			lifetime: time.Minute,
+		},
+	}
+	for i, j := range ts {
+		e := &cacheEntry{
+			Status:   j.status,
+			Header:   j.hd,
+			ReqTime:  now,
+			RespTime: now,
+		}
+		later := now.Add(10 * time.Second)
+		r := ht.NewRequest(h.MethodGet, "http://example.com", nil)
+		if j.reqCC != "" {
+			r.Header.Set("Cache-Control", j.reqCC)
+		}
+		require.Equal(t, j.lifetime, e.lifetime(), "At %d", i)
+		if j.age != 0 {
+			later = now.Add(j.age - e.age(now))
+		}
+		require.Equal(t, j.usable, e.usable(r, later), "At %d", i)
+	}
+}
+
+func TestCache(t *testing.T) {
+	// the fake clock is shared by the cache and the origin, for
+	// computing ages with the Date header
+	var mtx sync.Mutex
+	now := time.Now()
+	requests := make(map[string]int)
+	clock := func() (t time.Time) {
+		mtx.Lock()
+		t = now
+		mtx.Unlock()
+		return
+	}
+	advance := func(d time.Duration) {
+		mtx.Lock()
+		now = now.Add(d)
+		mtx.Unlock()
+	}
+	count := func(path string) (n int) {
+		mtx.Lock()
+		n = requests[path]
+		mtx.Unlock()
+		return
+	}
+	origin := ht.NewServer(h.HandlerFunc(func(w h.ResponseWriter,
+		r *h.Request) {
+		mtx.Lock()
+		requests[r.URL.Path]++
+		n := requests[r.URL.Path]
+		w.Header().Set("Date", now.UTC().Format(h.TimeFormat))
+		mtx.Unlock()
+		switch r.URL.Path {
+		case "/fresh":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Etag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(h.StatusNotModified)
+				return
+			}
+		case "/vary":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Vary", "Accept-Language")
+			w.Write([]byte(r.Header.Get("Accept-Language")))
+			return
+		case "/no-store":
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		fmt.Fprintf(w, "%s %d", r.URL.Path, n)
+	}))
+	defer origin.Close()
+
+	cache, e := NewCache(1<<20, "", 0)
+	require.NoError(t, e)
+	cache.now = clock
+	var denied error
+	p := NewProxy(func(ctx context.Context, n,
+		a string) (net.Conn, error) {
+		mtx.Lock()
+		e := denied
+		mtx.Unlock()
+		if e != nil {
+			return nil, e
+		}
+		return new(net.Dialer).DialContext(ctx, n, a)
+	})
+	cache.Policy = func(*ReqParams) (e error) { return }
+	p.Cache = cache
+	logs := new(bytes.Buffer)
+	p.Log = log.New(logs, "", 0)
+	std := ht.NewServer(p)
+	defer std.Close()
+	proxyURL, _ := url.Parse(std.URL)
+	cl := &h.Client{Transport: &h.Transport{
+		Proxy: h.ProxyURL(proxyURL),
+	}}
+	get := func(method, path string, hd h.Header, status int,
+		xCache, body string) {
+		r, _ := h.NewRequest(method, origin.URL+path, nil)
+		for k, v := range hd {
+			r.Header[k] = v
+		}
+		resp, e := cl.Do(r)
+		require.NoError(t, e)
+		bs, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.Equal(t, status, resp.StatusCode, path)
+		require.Equal(t, xCache, resp.Header.Get("X-Cache"), path)
+		require.Equal(t, body, string(bs), path)
+	}
+	get(h.MethodGet, "/fresh", nil, 200, CacheMiss, "/fresh 1")
+	advance(10 * time.Second)
+	get(h.MethodGet, "/fresh", nil, 200, CacheHit, "/fresh 1")
+	get(h.MethodHead, "/fresh", nil, 200, CacheHit, "")
+	get(h.MethodGet, "/fresh", h.Header{"If-None-Match": {`"v1"`}},
+		304, CacheHit, "")
+	// stale, revalidated with the ETag
+	advance(time.Minute)
+	get(h.MethodGet, "/fresh", nil, 200, CacheRevalidated,
+		"/fresh 1")
+	get(h.MethodGet, "/fresh", nil, 200, CacheHit, "/fresh 1")
+	get(h.MethodGet, "/fresh", h.Header{"Cache-Control": {"no-cache"}},
+		200, CacheRevalidated, "/fresh 1")
+	require.Equal(t, 3, count("/fresh"))
+	// unsafe methods invalidate
+	get(h.MethodPost, "/fresh", nil, 200, "", "/fresh 4")
+	get(h.MethodGet, "/fresh", nil, 200, CacheMiss, "/fresh 5")
+
+	es := h.Header{"Accept-Language": {"es"}}
+	en := h.Header{"Accept-Language": {"en"}}
+	get(h.MethodGet, "/vary", es, 200, CacheMiss, "es")
+	get(h.MethodGet, "/vary", en, 200, CacheMiss, "en")
+	get(h.MethodGet, "/vary", es, 200, CacheHit, "es")
+	get(h.MethodGet, "/vary", en, 200, CacheHit, "en")
+
+	get(h.MethodGet, "/no-store", nil, 200, CacheMiss, "/no-store 1")
+	get(h.MethodGet, "/no-store", nil, 200, CacheMiss, "/no-store 2")
+
+	ls := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	require.Equal(t, 15, len(ls))
+	fs := strings.Fields(ls[1])
+	require.Equal(t, []string{"127.0.0.1", h.MethodGet,
+		origin.URL + "/fresh", "200", CacheHit}, fs[:5])
+
+	// stored responses are sent without dialing, only to the
+	// clients the Policy allows
+	mtx.Lock()
+	denied = fmt.Errorf("denied")
+	mtx.Unlock()
+	get(h.MethodGet, "/vary", es, 200, CacheHit, "es")
+	mtx.Lock()
+	denied = nil
+	mtx.Unlock()
+	cache.Policy = func(rqp *ReqParams) (e error) {
+		if rqp.URL == origin.Listener.Addr().String() {
+			e = &HTTPErr{
+				Status: h.StatusForbidden,
+				Err:    fmt.Errorf("denied"),
+			}
+		}
+		return
+	}
+	get(h.MethodGet, "/vary", es, h.StatusForbidden, "", "denied\n")
+	// none of them reached the origin
+	require.Equal(t, 2, count("/vary"))
+	// a Cache without Policy isn't used
+	cache.Policy = nil
+	get(h.MethodGet, "/vary", es, 200, "", "es")
+	require.Equal(t, 3, count("/vary"))
+}
+
+func TestCacheTiers(t *testing.T) {
+	dir, e := ioutil.TempDir("", "cache")
+	require.NoError(t, e)
+	defer os.RemoveAll(dir)
+	object := func(key string, size int) (o *cacheObject) {
+		o = &cacheObject{Key: key, Variants: []*cacheEntry{
+			{Status: 200, Body: bytes.Repeat([]byte("a"), size)},
+		}}
+		return
+	}
+	c, e := NewCache(10000, dir, 25000)
+	require.NoError(t, e)
+	inDisk := func(key string) (ok bool) {
+		c.mtx.Lock()
+		ok = c.disk.lookup(key) != ""
+		c.mtx.Unlock()
+		return
+	}
+	c.store(object("a", 6000))
+	c.store(object("b", 6000))
+	// a was moved to disk
+	require.Nil(t, c.mem.get("a"))
+	require.True(t, inDisk("a"))
+	// too big for memory
+	c.store(object("c", 15000))
+	require.Nil(t, c.mem.get("c"))
+	require.True(t, inDisk("c"))
+	require.Equal(t, 0, len(c.pending))
+	// loading a keeps it in disk, without writing it again,
+	// and its body is read from there
+	c.mtx.Lock()
+	name := c.disk.lookup("a")
+	c.mtx.Unlock()
+	a := c.load("a")
+	require.Equal(t, "a", a.Key)
+	require.Nil(t, c.mem.get("a"))
+	c.mtx.Lock()
+	require.Equal(t, name, c.disk.lookup("a"))
+	c.mtx.Unlock()
+	r, e := a.Variants[0].body()
+	require.NoError(t, e)
+	bs, e := ioutil.ReadAll(r)
+	r.Close()
+	require.NoError(t, e)
+	require.Equal(t, bytes.Repeat([]byte("a"), 6000), bs)
+
+	// an object replaced or removed while being written isn't
+	// stored
+	d := object("d", 15000)
+	c.pending["d"] = object("d", 1)
+	c.demote(d)
+	require.False(t, inDisk("d"))
+
+	// the disk objects persist
+	c, e = NewCache(10000, dir, 25000)
+	require.NoError(t, e)
+	require.Equal(t, "a", c.load("a").Key)
+	require.Equal(t, "c", c.load("c").Key)
+	// the least recently used are evicted from disk
+	c.store(object("e", 20000))
+	require.Nil(t, c.load("a"))
+	require.Nil(t, c.load("c"))
+	require.NotNil(t, c.load("e"))
+	// only the disk objects are in dir
+	fs, e := ioutil.ReadDir(dir)
+	require.NoError(t, e)
+	require.Equal(t, 1, len(fs))
+}
+
+func TestCacheLargeObjects(t *testing.T) {
+	dir, e := ioutil.TempDir("", "cache")
+	require.NoError(t, e)
+	defer os.RemoveAll(dir)
+	big := bytes.Repeat([]byte("a"), 2*spoolSize)
+	origin := ht.NewServer(h.HandlerFunc(func(w h.ResponseWriter,
+		r *h.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		n := len(big)
+		if r.URL.Path == "/huge" {
+			n = 3 * spoolSize
+		}
+		// without Content-Length
+		w.(h.Flusher).Flush()
+		w.Write(big[:n/2])
+		w.Write(big[:n-n/2])
+	}))
+	defer origin.Close()
+	dial := func(ctx context.Context, n, a string) (net.Conn, error) {
+		return new(net.Dialer).DialContext(ctx, n, a)
+	}
+	get := func(c *Cache, path, xCache string, n int) {
+		p := NewProxy(dial)
+		c.Policy = func(*ReqParams) (e error) { return }
+		p.Cache = c
+		std := ht.NewServer(p)
+		defer std.Close()
+		proxyURL, _ := url.Parse(std.URL)
+		cl := &h.Client{Transport: &h.Transport{
+			Proxy: h.ProxyURL(proxyURL),
+		}}
+		resp, e := cl.Get(origin.URL + path)
+		require.NoError(t, e)
+		bs, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.Equal(t, xCache, resp.Header.Get("X-Cache"), path)
+		require.Equal(t, n, len(bs), path)
+	}
+
+	// bodies bigger than spoolSize are stored through a file,
+	// and the bigger than MaxObject aren't stored
+	c, e := NewCache(spoolSize, dir, 1<<30)
+	require.NoError(t, e)
+	c.MaxObject = 5 * spoolSize / 2
+	get(c, "/big", CacheMiss, len(big))
+	get(c, "/big", CacheHit, len(big))
+	get(c, "/huge", CacheMiss, 3*spoolSize)
+	get(c, "/huge", CacheMiss, 3*spoolSize)
+	require.Nil(t, c.mem.get(origin.URL+"/big"))
+	fs, e := ioutil.ReadDir(dir)
+	require.NoError(t, e)
+	require.Equal(t, 1, len(fs))
+	require.True(t, fs[0].Size() > int64(len(big)))
+
+	// without directory the bodies are stored only if they
+	// fit in memory
+	c, e = NewCache(8*spoolSize, "", 0)
+	require.NoError(t, e)
+	require.Equal(t, int64(DefaultMaxObject), c.maxObject())
+	c.MaxObject = 1 << 30
+	require.Equal(t, int64(8*spoolSize), c.maxObject())
+	get(c, "/big", CacheMiss, len(big))
+	get(c, "/big", CacheHit, len(big))
+}
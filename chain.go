@@ -0,0 +1,174 @@
+// Copyright © 2018-2019 Luis Ángel Méndez Gort
+
+// This file is part of Proxy.
+
+// Proxy is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General
+// Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your
+// option) any later version.
+
+// Proxy is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the
+// implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU Lesser General Public
+// License for more details.
+
+// You should have received a copy of the GNU Lesser General
+// Public License along with Proxy.  If not, see
+// <https://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	gp "golang.org/x/net/proxy"
+)
+
+// Hop is a parent proxy in a ChainDialer
+type Hop struct {
+	// URL has a scheme supported by
+	// golang.org/x/net/proxy.FromURL, like "http", "https"
+	// and "socks5"
+	URL *url.URL
+	// Timeout, when not zero, bounds the time the hop takes
+	// for connecting to the next one, or to the destination,
+	// once connected to it
+	Timeout time.Duration
+}
+
+// ChainDialer dials through a chain of parent proxies, where
+// the first hop is reached using Direct and every other one
+// through the previous. It implements the
+// golang.org/x/proxy.ContextDialer interface
+type ChainDialer struct {
+	Hops   []Hop
+	Direct gp.Dialer
+}
+
+func (d *ChainDialer) Dial(network, addr string) (n net.Conn,
+	e error) {
+	n, e = d.DialContext(context.Background(), network, addr)
+	return
+}
+
+// DialContext connects to addr through the chain, returning
+// a *HopErr when a hop fails. The "udp" networks are only
+// dialed without hops
+func (d *ChainDialer) DialContext(ctx context.Context, network,
+	addr string) (n net.Conn, e error) {
+	registerDialers()
+	forward := d.Direct
+	for i, j := range d.Hops {
+		forward = &hopDialer{index: i, hop: j, forward: forward}
+	}
+	if len(d.Hops) != 0 && strings.HasPrefix(network, "udp") {
+		e = noUDPParent()
+	} else {
+		n, e = dialContext(ctx, forward, network, addr)
+	}
+	return
+}
+
+// hopDialer dials through a hop, reached using forward
+type hopDialer struct {
+	index   int
+	hop     Hop
+	forward gp.Dialer
+}
+
+func (d *hopDialer) Dial(network, addr string) (n net.Conn,
+	e error) {
+	n, e = d.DialContext(context.Background(), network, addr)
+	return
+}
+
+func (d *hopDialer) DialContext(ctx context.Context, network,
+	addr string) (n net.Conn, e error) {
+	hctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	timers := make(chan *time.Timer, 1)
+	var once sync.Once
+	fw := &reachDialer{
+		forward: d.forward,
+		reached: func() {
+			// the timeout counts from the first time the hop
+			// is reached, which happens again when
+			// authenticating closes the connection
+			once.Do(func() {
+				if d.hop.Timeout != 0 {
+					timers <- time.AfterFunc(d.hop.Timeout, cancel)
+				}
+			})
+		},
+	}
+	var pd gp.Dialer
+	pd, e = gp.FromURL(d.hop.URL, fw)
+	if e == nil {
+		n, e = dialContext(hctx, pd, network, addr)
+	}
+	select {
+	case t := <-timers:
+		t.Stop()
+	default:
+	}
+	if e != nil && ctx.Err() == nil && hctx.Err() != nil {
+		e = context.DeadlineExceeded
+	}
+	var he *HopErr
+	if e != nil && !errors.As(e, &he) {
+		// errors of previous hops pass unchanged
+		e = &HopErr{Hop: d.index, URL: d.hop.URL, Err: e}
+	}
+	return
+}
+
+// reachDialer dials with forward, calling reached when
+// it succeeds
+type reachDialer struct {
+	forward gp.Dialer
+	reached func()
+}
+
+func (d *reachDialer) Dial(network, addr string) (n net.Conn,
+	e error) {
+	n, e = d.DialContext(context.Background(), network, addr)
+	return
+}
+
+func (d *reachDialer) DialContext(ctx context.Context, network,
+	addr string) (n net.Conn, e error) {
+	n, e = dialContext(ctx, d.forward, network, addr)
+	if e == nil {
+		d.reached()
+	}
+	return
+}
+
+// HopErr is returned by ChainDialer when a hop fails, either
+// reaching it or connecting through it
+type HopErr struct {
+	// Hop is the index of the hop in the chain
+	Hop int
+	URL *url.URL
+	Err error
+}
+
+func (e *HopErr) Error() (s string) {
+	s = fmt.Sprintf("Hop %d (%s://%s): %s", e.Hop, e.URL.Scheme,
+		e.URL.Host, e.Err.Error())
+	return
+}
+
+func (e *HopErr) Unwrap() (r error) {
+	r = e.Err
+	return
+}
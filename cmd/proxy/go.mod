@@ -0,0 +1,22 @@
+module github.com/lamg/proxy/cmd/proxy
+
+go 1.26.0
+
+require (
+	github.com/lamg/algorithms v0.0.0-20190516184438-e8502d0eb72f
+	github.com/lamg/proxy v0.0.0-20261018231149-722a8462f242
+	github.com/lamg/proxy/h3 v0.0.0-20261018231149-722a8462f242
+	github.com/valyala/fasthttp v1.34.0
+	golang.org/x/net v0.56.0
+)
+
+require (
+	github.com/andybalholm/brotli v1.0.4 // indirect
+	github.com/klauspost/compress v1.15.0 // indirect
+	github.com/quic-go/qpack v0.6.0 // indirect
+	github.com/quic-go/quic-go v0.63.0 // indirect
+	github.com/valyala/bytebufferpool v1.0.0 // indirect
+	golang.org/x/crypto v0.54.0 // indirect
+	golang.org/x/sys v0.47.0 // indirect
+	golang.org/x/text v0.40.0 // indirect
+)
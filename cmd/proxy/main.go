@@ -25,50 +25,197 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
-
+	"io/ioutil"
 	"log"
 	"net"
 	h "net/http"
 	"net/url"
+	"os"
+	"strings"
 	"time"
 
 	fh "github.com/valyala/fasthttp"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 
 	alg "github.com/lamg/algorithms"
 	"github.com/lamg/proxy"
+	"github.com/lamg/proxy/h3"
 )
 
 func main() {
-	var addr, lrange, proxyURL string
-	var fastH bool
+	var addr, lrange, proxyURL, transAddr, sniAddr, quicAddr string
+	var mitmCA, intercept, bypass string
+	var certFile, keyFile, clientCA string
+	var cacheDir, reqMod, respMod string
+	var cacheMem, cacheDisk, cacheObject, reqLimit, respLimit int64
+	var fastH, fastStream, accessLog, icapOpen, h2cOn bool
 	flag.StringVar(&addr, "a", ":8080", "Server address")
+	flag.StringVar(&transAddr, "t", "",
+		"Transparent proxy address (Linux only)")
+	flag.StringVar(&sniAddr, "s", "",
+		"TLS passthrough address, relaying by server name")
+	flag.StringVar(&quicAddr, "q", "",
+		"UDP address for serving HTTP/3 and CONNECT-UDP, with the "+
+			"certificate of -c")
+	flag.StringVar(&mitmCA, "m", "",
+		"CA certificate and key files, separated by comma, "+
+			"for intercepting TLS")
+	flag.StringVar(&intercept, "i", "",
+		"Comma separated domains whose TLS is intercepted, "+
+			"'.' for all of them")
+	flag.StringVar(&bypass, "b", "",
+		"Comma separated domains never intercepted")
+	flag.StringVar(&certFile, "c", "",
+		"Certificate file for serving the proxy over TLS, with "+
+			"HTTP/2 unless -f. Its extended CONNECT (WebSocket) needs "+
+			"GODEBUG=http2xconnect=1")
+	flag.StringVar(&keyFile, "k", "",
+		"Key file for serving the proxy over TLS")
+	flag.StringVar(&clientCA, "ca", "",
+		"CA certificates file for authenticating TLS clients")
 	flag.StringVar(&lrange, "r", "127.0.0.1/32",
 		"CIDR range for listening")
-	flag.StringVar(&proxyURL, "p", "", "Parent proxy address")
+	flag.StringVar(&proxyURL, "p", "", "Parent proxy URL, or "+
+		"comma separated URLs of a chain of them. With https, the "+
+		"query can have the files 'ca', 'cert' and 'key', and the "+
+		"server name 'sni'")
+	flag.Int64Var(&cacheMem, "cm", 0,
+		"Bytes of memory for caching HTTP responses, no cache "+
+			"when 0")
+	flag.StringVar(&cacheDir, "cd", "",
+		"Directory for caching the responses not fitting in memory")
+	flag.Int64Var(&cacheDisk, "cs", 1<<30,
+		"Bytes of the cache directory")
+	flag.Int64Var(&cacheObject, "co", proxy.DefaultMaxObject,
+		"Bytes of the biggest response body cached")
+	flag.Int64Var(&reqLimit, "lq", 0,
+		"Maximum bytes of the HTTP request bodies, no limit when 0")
+	flag.Int64Var(&respLimit, "lr", 0,
+		"Maximum bytes of the HTTP response bodies, no limit when 0")
+	flag.StringVar(&reqMod, "iq", "",
+		"ICAP REQMOD service URL, for adapting the HTTP requests")
+	flag.StringVar(&respMod, "ip", "",
+		"ICAP RESPMOD service URL, for adapting the HTTP responses")
+	flag.BoolVar(&icapOpen, "io", false,
+		"Forward the HTTP messages when the ICAP server fails")
+	flag.BoolVar(&accessLog, "l", false,
+		"Log the HTTP requests to the standard error")
 	flag.BoolVar(&fastH, "f", false,
 		"Use github.com/valyala/fasthttp")
+	flag.BoolVar(&fastStream, "fs", false,
+		"Stream the bodies with fasthttp instead of buffering them")
+	flag.BoolVar(&h2cOn, "h2c", false,
+		"Accept HTTP/2 without TLS (h2c)")
 	flag.Parse()
 
 	var e error
-	var parentProxy *url.URL
-	if proxyURL != "" {
-		parentProxy, e = url.Parse(proxyURL)
-		if !(parentProxy.Scheme == "http" ||
-			parentProxy.Scheme == "socks5") {
-			e = fmt.Errorf("Not recognized URL scheme '%s', "+
-				"must be 'http' or 'socks5'", parentProxy.Scheme)
-		}
+	if quicAddr != "" && (certFile == "" || fastH) {
+		e = fmt.Errorf("HTTP/3 needs -c, and isn't supported with -f")
+	}
+	if e == nil && fastStream && !fastH {
+		e = fmt.Errorf("-fs needs -f")
+	}
+	if e == nil && fastH && (reqMod != "" || respMod != "") {
+		// the ICAP middleware has no fasthttp functions
+		e = fmt.Errorf("ICAP isn't supported with -f")
+	}
+	if e == nil && fastH && mitmCA != "" {
+		// interception is done by the net/http front end
+		e = fmt.Errorf("MITM isn't supported with -f")
 	}
-	ar, e := newAllowedRanges(parentProxy, lrange)
+	if e == nil && fastH && anySet("cm", "cd", "cs", "co") {
+		// the cache is consulted by the net/http front end
+		e = fmt.Errorf("Caching isn't supported with -f")
+	}
+	if e == nil && fastH && h2cOn {
+		e = fmt.Errorf("-h2c isn't supported with -f")
+	}
+	var hops []proxy.Hop
+	if e == nil && proxyURL != "" {
+		hops, e = parseHops(proxyURL)
+	}
+	var ar *allowedRanges
+	if e == nil {
+		ar, e = newAllowedRanges(hops, lrange)
+	}
+	var np *proxy.Proxy
 	if e == nil {
 		if fastH {
-			np := proxy.NewFastProxy(ar.DialContext)
-			e = fh.ListenAndServe(addr, np.RequestHandler)
+			np = proxy.NewFastProxy(ar.DialContext)
+			np.FastStream = fastStream
 		} else {
-			np := proxy.NewProxy(ar.DialContext)
-			e = standardSrv(np, addr)
+			np = proxy.NewProxy(ar.DialContext)
+		}
+		if mitmCA != "" {
+			np.MITM, e = newMITM(mitmCA, intercept, bypass)
+		}
+		if e == nil && cacheMem != 0 {
+			np.Cache, e = proxy.NewCache(cacheMem, cacheDir, cacheDisk)
+		}
+		if e == nil && np.Cache != nil {
+			np.Cache.Policy = ar.allowed
+			np.Cache.MaxObject = cacheObject
+		}
+		if reqLimit != 0 || respLimit != 0 {
+			np.Limits = &proxy.BodyLimits{
+				Request:  reqLimit,
+				Response: respLimit,
+			}
+		}
+		if reqMod != "" || respMod != "" {
+			icap := &proxy.ICAP{
+				ReqMod:   reqMod,
+				RespMod:  respMod,
+				FailOpen: icapOpen,
+				Timeout:  30 * time.Second,
+			}
+			np.Middlewares = append(np.Middlewares, icap.Middleware())
+		}
+		if accessLog {
+			np.Log = log.New(os.Stderr, "", log.LstdFlags)
+		}
+	}
+	var tlsConf *tls.Config
+	if e == nil && certFile != "" {
+		tlsConf, e = newTLSConfig(certFile, keyFile, clientCA)
+	}
+	if e == nil && tlsConf != nil && !fastH {
+		tlsConf.NextProtos = []string{"h2", "http/1.1"}
+	}
+	if e == nil {
+		if transAddr != "" {
+			go listenSrv(np.ServeTransparent, transAddr)
+		}
+		if sniAddr != "" {
+			go listenSrv(np.ServeSNI, sniAddr)
+		}
+		if quicAddr != "" {
+			go listenQUIC(np, quicAddr, tlsConf.Clone())
+		}
+		var l net.Listener
+		l, e = net.Listen("tcp", addr)
+		if e == nil && tlsConf != nil {
+			l = tls.NewListener(l, tlsConf)
+		}
+		if e == nil && fastH {
+			server := &fh.Server{
+				Handler:           np.RequestHandler,
+				StreamRequestBody: fastStream,
+			}
+			// the proxy enforces the limits, which can be above
+			// the default one of fasthttp
+			if n := np.Limits.MaxRequest(); n != 0 {
+				server.MaxRequestBodySize = int(n)
+			}
+			e = server.Serve(l)
+		} else if e == nil && h2cOn {
+			e = standardSrv(h2c.NewHandler(np, new(http2.Server)), l)
+		} else if e == nil {
+			e = standardSrv(np, l)
 		}
 	}
 	if e != nil {
@@ -76,32 +223,117 @@ func main() {
 	}
 }
 
-func standardSrv(hn h.Handler, addr string) (e error) {
+// anySet returns whether any of the flags with the names was
+// set in the command line
+func anySet(names ...string) (ok bool) {
+	flag.Visit(func(f *flag.Flag) {
+		for _, n := range names {
+			ok = ok || f.Name == n
+		}
+	})
+	return
+}
+
+func standardSrv(hn h.Handler, l net.Listener) (e error) {
 	server := &h.Server{
-		Addr:         addr,
 		Handler:      hn,
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 10 * time.Second,
-		// Disable HTTP/2.
-		TLSNextProto: make(map[string]func(*h.Server, *tls.Conn,
-			h.Handler)),
 	}
-	e = server.ListenAndServe()
+	e = server.Serve(l)
+	return
+}
+
+func newTLSConfig(certFile, keyFile,
+	clientCA string) (c *tls.Config, e error) {
+	var r *proxy.CertReloader
+	r, e = proxy.NewCertReloader(certFile, keyFile)
+	var pool *x509.CertPool
+	if e == nil && clientCA != "" {
+		var bs []byte
+		bs, e = ioutil.ReadFile(clientCA)
+		pool = x509.NewCertPool()
+		if e == nil && !pool.AppendCertsFromPEM(bs) {
+			e = fmt.Errorf("No certificates in '%s'", clientCA)
+		}
+	}
+	if e == nil {
+		r.ReloadOnSIGHUP(func(e error) { log.Print(e) })
+		c = proxy.NewTLSConfig(r, pool)
+	}
+	return
+}
+
+func newMITM(ca, intercept, bypass string) (m *proxy.MITM,
+	e error) {
+	files := strings.Split(ca, ",")
+	if len(files) != 2 {
+		e = fmt.Errorf("Expecting certificate and key files, "+
+			"got '%s'", ca)
+	}
+	if e == nil {
+		m, e = proxy.NewMITM(files[0], files[1])
+	}
+	if e == nil {
+		if intercept != "" {
+			m.Hosts = strings.Split(intercept, ",")
+		}
+		if bypass != "" {
+			m.Bypass = strings.Split(bypass, ",")
+		}
+	}
+	return
+}
+
+func parseHops(urls string) (hops []proxy.Hop, e error) {
+	ss := strings.Split(urls, ",")
+	hops = make([]proxy.Hop, len(ss))
+	for i := 0; e == nil && i != len(ss); i++ {
+		hops[i].URL, e = url.Parse(ss[i])
+		schemes := []string{"http", "https", "socks4", "socks4a",
+			"socks5"}
+		if e == nil {
+			ok, _ := alg.BLnSrch(func(j int) bool {
+				return hops[i].URL.Scheme == schemes[j]
+			}, len(schemes))
+			if !ok {
+				e = fmt.Errorf("Not recognized URL scheme '%s', "+
+					"must be one of %s", hops[i].URL.Scheme,
+					strings.Join(schemes, ", "))
+			}
+		}
+	}
 	return
 }
 
+func listenSrv(serve func(net.Listener) error, addr string) {
+	l, e := net.Listen("tcp", addr)
+	if e == nil {
+		e = serve(l)
+	}
+	log.Fatal(e)
+}
+
+func listenQUIC(p *proxy.Proxy, addr string, c *tls.Config) {
+	pc, e := net.ListenPacket("udp", addr)
+	if e == nil {
+		e = h3.Serve(p, pc, c)
+	}
+	log.Fatal(e)
+}
+
 type allowedRanges struct {
-	ranges      []*net.IPNet
-	parentProxy *url.URL
-	timeout     time.Duration
+	ranges  []*net.IPNet
+	hops    []proxy.Hop
+	timeout time.Duration
 }
 
-func newAllowedRanges(parentProxy *url.URL,
+func newAllowedRanges(hops []proxy.Hop,
 	cidrs ...string) (a *allowedRanges, e error) {
 	a = &allowedRanges{
-		ranges:      make([]*net.IPNet, len(cidrs)),
-		parentProxy: parentProxy,
-		timeout:     90 * time.Second,
+		ranges:  make([]*net.IPNet, len(cidrs)),
+		hops:    hops,
+		timeout: 90 * time.Second,
 	}
 	ib := func(i int) (b bool) {
 		_, a.ranges[i], e = net.ParseCIDR(cidrs[i])
@@ -112,9 +344,9 @@ func newAllowedRanges(parentProxy *url.URL,
 	return
 }
 
-func (r *allowedRanges) DialContext(ctx context.Context, network,
-	addr string) (c net.Conn, e error) {
-	rqp := ctx.Value(proxy.ReqParamsK).(*proxy.ReqParams)
+// allowed returns an error when the client of rqp is out of
+// the ranges
+func (r *allowedRanges) allowed(rqp *proxy.ReqParams) (e error) {
 	ip := net.ParseIP(rqp.IP)
 	ok, _ := alg.BLnSrch(
 		func(i int) bool { return r.ranges[i].Contains(ip) },
@@ -123,12 +355,20 @@ func (r *allowedRanges) DialContext(ctx context.Context, network,
 	if !ok {
 		e = fmt.Errorf("Client IP '%s' out of range", rqp.IP)
 	}
+	return
+}
+
+func (r *allowedRanges) DialContext(ctx context.Context, network,
+	addr string) (c net.Conn, e error) {
+	rqp := ctx.Value(proxy.ReqParamsK).(*proxy.ReqParams)
+	e = r.allowed(rqp)
 	if e == nil {
 		ifd := &proxy.IfaceDialer{Timeout: r.timeout}
-		if r.parentProxy != nil {
-			c, e = proxy.DialProxy(network, addr, r.parentProxy, ifd)
+		if len(r.hops) != 0 {
+			chain := &proxy.ChainDialer{Hops: r.hops, Direct: ifd}
+			c, e = chain.DialContext(ctx, network, addr)
 		} else {
-			c, e = ifd.Dial(network, addr)
+			c, e = ifd.DialContext(ctx, network, addr)
 		}
 	}
 	return
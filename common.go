@@ -23,9 +23,9 @@ package proxy
 import (
 	"context"
 	"fmt"
-	alg "github.com/lamg/algorithms"
 	"io"
 	"net"
+	"strings"
 	"sync"
 )
 
@@ -43,20 +43,85 @@ func noHijacking() (e error) {
 	return
 }
 
-func searchHopByHop(hd string) (ok bool) {
-	// hop-by-hop headers. Shouldn't be sent to the
-	// requested host.
-	// https://developer.mozilla.org/en-US/docs/
-	// Web/HTTP/Headers#hbh
-	hbh := []string{
-		"Connection", "Keep-Alive", "Proxy-Authenticate",
-		"Proxy-Authorization", "TE", "Trailer",
-		"Transfer-Encoding", "Upgrade",
+// noStreaming error
+func noStreaming() (e error) {
+	e = fmt.Errorf("No response streaming supported")
+	return
+}
+
+// notSwitched error
+func notSwitched(status int) (e error) {
+	e = fmt.Errorf("Expecting switching protocols answer to the "+
+		"upgrade request, got %d", status)
+	return
+}
+
+// noStreamDeadlines error
+func noStreamDeadlines() (e error) {
+	e = fmt.Errorf("No HTTP/2 tunnels supported before Go 1.20")
+	return
+}
+
+// noDatagrams error
+func noDatagrams() (e error) {
+	e = fmt.Errorf("No HTTP datagrams supported")
+	return
+}
+
+// malformedUDPTarget error
+func malformedUDPTarget(path string) (e error) {
+	e = fmt.Errorf("Malformed UDP proxying path '%s'", path)
+	return
+}
+
+// noUDPParent error
+func noUDPParent() (e error) {
+	e = fmt.Errorf("Parent proxies don't relay UDP")
+	return
+}
+
+// invalidStatus error
+func invalidStatus(status int) (e error) {
+	e = fmt.Errorf("Invalid status code %d", status)
+	return
+}
+
+// notReplayed error
+func notReplayed(service string) (e error) {
+	e = fmt.Errorf("ICAP service '%s' didn't modify a body too "+
+		"big for replaying it", service)
+	return
+}
+
+// isUpgrade returns whether the connection and upgrade
+// header values request switching protocols
+func isUpgrade(connection []string, upgrade string) (ok bool) {
+	for i := 0; !ok && i != len(connection); i++ {
+		ok = hasToken(connection[i], "upgrade")
 	}
-	ib := func(i int) (b bool) {
-		b = hbh[i] == hd
-		return
+	ok = ok && upgrade != ""
+	return
+}
+
+// hasToken returns whether the comma separated list v has
+// token, ignoring case
+func hasToken(v, token string) (ok bool) {
+	ts := strings.Split(v, ",")
+	for i := 0; !ok && i != len(ts); i++ {
+		ok = strings.EqualFold(strings.TrimSpace(ts[i]), token)
 	}
-	ok, _ = alg.BLnSrch(ib, len(hbh))
+	return
+}
+
+// loopDetected error
+func loopDetected() (e error) {
+	e = fmt.Errorf("Loop detected: request already forwarded by " +
+		"this proxy")
+	return
+}
+
+// noOriginalDst error
+func noOriginalDst() (e error) {
+	e = fmt.Errorf("No original destination for connection")
 	return
 }
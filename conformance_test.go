@@ -0,0 +1,266 @@
+// Copyright © 2018-2019 Luis Ángel Méndez Gort
+
+// This file is part of Proxy.
+
+// Proxy is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General
+// Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your
+// option) any later version.
+
+// Proxy is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the
+// implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU Lesser General Public
+// License for more details.
+
+// You should have received a copy of the GNU Lesser General
+// Public License along with Proxy.  If not, see
+// <https://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	h "net/http"
+	ht "net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	fh "github.com/valyala/fasthttp"
+)
+
+// conformanceCase is a request sent through both front ends,
+// checked at the origin and at the client
+type conformanceCase struct {
+	name string
+	// request is sent as is, after replacing ORIGIN by the
+	// origin address
+	request string
+	origin  h.HandlerFunc
+	status  int
+	// check, when not nil, checks the response
+	check func(t *testing.T, resp *h.Response, body string)
+	// closed means the proxy must close the connection after
+	// responding
+	closed bool
+}
+
+var conformanceCases = []conformanceCase{
+	{
+		name: "request headers don't reach the response",
+		request: "GET http://ORIGIN/ HTTP/1.1\r\nHost: ORIGIN\r\n" +
+			"X-Client: bla\r\n\r\n",
+		origin: func(w h.ResponseWriter, r *h.Request) {
+			w.Write([]byte("blabla"))
+		},
+		status: h.StatusOK,
+		check: func(t *testing.T, resp *h.Response, body string) {
+			require.Equal(t, "", resp.Header.Get("X-Client"))
+			require.Equal(t, "blabla", body)
+		},
+	},
+	{
+		name: "hop-by-hop request headers are removed",
+		request: "GET http://ORIGIN/ HTTP/1.1\r\nHost: ORIGIN\r\n" +
+			"Connection: keep-alive, X-Hop\r\nX-Hop: 1\r\n" +
+			"Keep-Alive: timeout=5\r\nTE: trailers\r\n" +
+			"Proxy-Authorization: Basic cGVwZTpwYXNz\r\n" +
+			"Proxy-Connection: keep-alive\r\nX-End: 1\r\n\r\n",
+		origin: func(w h.ResponseWriter, r *h.Request) {
+			for _, k := range []string{"Connection", "X-Hop",
+				"Keep-Alive", "Te", "Proxy-Authorization",
+				"Proxy-Connection"} {
+				if _, ok := r.Header[k]; ok {
+					w.WriteHeader(h.StatusBadRequest)
+				}
+			}
+			if r.Header.Get("X-End") != "1" {
+				w.WriteHeader(h.StatusBadRequest)
+			}
+		},
+		status: h.StatusOK,
+	},
+	{
+		name: "hop-by-hop response headers are removed",
+		request: "GET http://ORIGIN/ HTTP/1.1\r\nHost: ORIGIN\r\n" +
+			"\r\n",
+		origin: func(w h.ResponseWriter, r *h.Request) {
+			w.Header().Set("Connection", "X-Secret")
+			w.Header().Set("X-Secret", "bla")
+			w.Header().Set("Keep-Alive", "timeout=5")
+			w.Header().Set("X-End", "1")
+		},
+		status: h.StatusOK,
+		check: func(t *testing.T, resp *h.Response, body string) {
+			require.Equal(t, "", resp.Header.Get("X-Secret"))
+			require.Equal(t, "", resp.Header.Get("Keep-Alive"))
+			require.Equal(t, "1", resp.Header.Get("X-End"))
+		},
+	},
+	{
+		name: "Via and X-Forwarded-For are appended",
+		request: "GET http://ORIGIN/ HTTP/1.1\r\nHost: ORIGIN\r\n" +
+			"X-Forwarded-For: 10.1.1.1\r\nVia: 1.0 first\r\n\r\n",
+		origin: func(w h.ResponseWriter, r *h.Request) {
+			if r.Header.Get("X-Forwarded-For") !=
+				"10.1.1.1, 127.0.0.1" ||
+				r.Header.Get("Via") != "1.0 first, 1.1 proxy" {
+				w.WriteHeader(h.StatusBadRequest)
+			}
+			w.Header().Set("Via", "1.1 origin")
+		},
+		status: h.StatusOK,
+		check: func(t *testing.T, resp *h.Response, body string) {
+			require.Equal(t, "1.1 origin, 1.1 proxy",
+				resp.Header.Get("Via"))
+		},
+	},
+	{
+		name: "no User-Agent is added",
+		request: "GET http://ORIGIN/ HTTP/1.1\r\nHost: ORIGIN\r\n" +
+			"\r\n",
+		origin: func(w h.ResponseWriter, r *h.Request) {
+			if _, ok := r.Header["User-Agent"]; ok {
+				w.WriteHeader(h.StatusBadRequest)
+			}
+		},
+		status: h.StatusOK,
+	},
+	{
+		name: "request body and status are forwarded",
+		request: "POST http://ORIGIN/ HTTP/1.1\r\nHost: ORIGIN\r\n" +
+			"Content-Length: 3\r\n\r\nbla",
+		origin: func(w h.ResponseWriter, r *h.Request) {
+			bs, _ := ioutil.ReadAll(r.Body)
+			w.WriteHeader(h.StatusNotFound)
+			w.Write(bs)
+		},
+		status: h.StatusNotFound,
+		check: func(t *testing.T, resp *h.Response, body string) {
+			require.Equal(t, "bla", body)
+		},
+	},
+	{
+		name: "chunked bodies are forwarded",
+		request: "POST http://ORIGIN/ HTTP/1.1\r\nHost: ORIGIN\r\n" +
+			"Transfer-Encoding: chunked\r\n\r\n" +
+			"3\r\nbla\r\n3\r\nble\r\n0\r\n\r\n",
+		origin: func(w h.ResponseWriter, r *h.Request) {
+			bs, _ := ioutil.ReadAll(r.Body)
+			w.Write(bs[:3])
+			w.(h.Flusher).Flush()
+			w.Write(bs[3:])
+		},
+		status: h.StatusOK,
+		check: func(t *testing.T, resp *h.Response, body string) {
+			require.Equal(t, "blable", body)
+		},
+	},
+	{
+		name: "interim responses are skipped",
+		request: "GET http://ORIGIN/ HTTP/1.1\r\nHost: ORIGIN\r\n" +
+			"\r\n",
+		origin: func(w h.ResponseWriter, r *h.Request) {
+			w.WriteHeader(h.StatusContinue)
+			w.Write([]byte("bla"))
+		},
+		status: h.StatusOK,
+		check: func(t *testing.T, resp *h.Response, body string) {
+			require.Equal(t, "bla", body)
+		},
+	},
+	{
+		name: "the client connection closes when asked",
+		request: "GET http://ORIGIN/ HTTP/1.1\r\nHost: ORIGIN\r\n" +
+			"Connection: close\r\n\r\n",
+		origin: func(w h.ResponseWriter, r *h.Request) {},
+		status: h.StatusOK,
+		closed: true,
+	},
+	{
+		name: "loops are detected",
+		request: "GET http://ORIGIN/ HTTP/1.1\r\nHost: ORIGIN\r\n" +
+			"Via: 1.1 proxy\r\n\r\n",
+		origin: func(w h.ResponseWriter, r *h.Request) {},
+		status: h.StatusLoopDetected,
+	},
+	{
+		name: "unreachable destinations",
+		request: "GET http://127.0.0.1:1/ HTTP/1.1\r\n" +
+			"Host: 127.0.0.1:1\r\n\r\n",
+		origin: func(w h.ResponseWriter, r *h.Request) {},
+		status: h.StatusServiceUnavailable,
+	},
+}
+
+func TestConformance(t *testing.T) {
+	dial := func(ctx context.Context, n, a string) (net.Conn,
+		error) {
+		return new(net.Dialer).DialContext(ctx, n, a)
+	}
+	hp := &HeaderPolicy{Pseudonym: "proxy", XForwardedFor: true}
+	sp := NewProxy(dial)
+	sp.Headers = hp
+	std := ht.NewServer(sp)
+	defer std.Close()
+	l, e := net.Listen(tcp, "127.0.0.1:0")
+	require.NoError(t, e)
+	defer l.Close()
+	fast := NewFastProxy(dial)
+	fast.Headers = hp
+	go fh.Serve(l, fast.RequestHandler)
+	sl, e := net.Listen(tcp, "127.0.0.1:0")
+	require.NoError(t, e)
+	defer sl.Close()
+	stream := NewFastProxy(dial)
+	stream.FastStream, stream.Headers = true, hp
+	go (&fh.Server{
+		Handler:           stream.RequestHandler,
+		StreamRequestBody: true,
+	}).Serve(sl)
+	frontEnds := map[string]string{
+		"net/http":         std.Listener.Addr().String(),
+		"fasthttp":         l.Addr().String(),
+		"fasthttp streams": sl.Addr().String(),
+	}
+	for _, j := range conformanceCases {
+		origin := ht.NewServer(j.origin)
+		for name, addr := range frontEnds {
+			t.Run(name+": "+j.name, func(t *testing.T) {
+				checkConformance(t, addr, origin, j)
+			})
+		}
+		origin.Close()
+	}
+}
+
+func checkConformance(t *testing.T, addr string,
+	origin *ht.Server, j conformanceCase) {
+	c, e := net.Dial(tcp, addr)
+	require.NoError(t, e)
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	_, e = c.Write([]byte(strings.Replace(j.request, "ORIGIN",
+		origin.Listener.Addr().String(), -1)))
+	require.NoError(t, e)
+	br := bufio.NewReader(c)
+	resp, e := h.ReadResponse(br, nil)
+	require.NoError(t, e)
+	bs, e := ioutil.ReadAll(resp.Body)
+	require.NoError(t, e)
+	require.Equal(t, j.status, resp.StatusCode, string(bs))
+	if j.check != nil {
+		j.check(t, resp, string(bs))
+	}
+	if j.closed {
+		_, e = br.ReadByte()
+		require.Equal(t, io.EOF, e)
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright © 2018-2019 Luis Ángel Méndez Gort
+
+// This file is part of Proxy.
+
+// Proxy is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General
+// Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your
+// option) any later version.
+
+// Proxy is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the
+// implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU Lesser General Public
+// License for more details.
+
+// You should have received a copy of the GNU Lesser General
+// Public License along with Proxy.  If not, see
+// <https://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	h "net/http"
+	"strings"
+	"time"
+)
+
+// DatagramStream is the stream of a request whose HTTP
+// datagrams (RFC 9297) can be sent and received
+type DatagramStream interface {
+	io.ReadCloser
+	SendDatagram([]byte) error
+	ReceiveDatagram(context.Context) ([]byte, error)
+}
+
+// DatagramStreamer is implemented by the response writers of
+// HTTP/3 servers with datagrams, like the ones of
+// github.com/lamg/proxy/h3, for relaying CONNECT-UDP
+type DatagramStreamer interface {
+	DatagramStream() DatagramStream
+}
+
+// udpPath is the default URI template path of RFC 9298
+const udpPath = "/.well-known/masque/udp/"
+
+// handleConnectUDP relays the UDP payloads in the HTTP/3
+// datagrams of the CONNECT-UDP request r to the target in
+// its path, and the ones received from it back
+func (p *Proxy) handleConnectUDP(w h.ResponseWriter, r *h.Request) {
+	start := time.Now()
+	rqp, _ := r.Context().Value(ReqParamsK).(*ReqParams)
+	streamer, ok := w.(DatagramStreamer)
+	var e error
+	status := h.StatusNotImplemented
+	if !ok {
+		e = noDatagrams()
+	}
+	if e == nil {
+		rqp.URL, e = udpTarget(r.URL.Path)
+		status = h.StatusBadRequest
+	}
+	if e == nil {
+		e = middlewares(p.Middlewares).connect(rqp)
+		status = errStatus(e, h.StatusForbidden)
+	}
+	var dest net.Conn
+	if e == nil {
+		dest, e = p.dialContext(r.Context(), "udp", rqp.URL)
+		status = h.StatusServiceUnavailable
+	}
+	if e == nil {
+		status = h.StatusOK
+		w.Header().Set("Capsule-Protocol", "?1")
+		w.WriteHeader(status)
+		w.(h.Flusher).Flush()
+		relayDatagrams(streamer.DatagramStream(), dest)
+	} else {
+		h.Error(w, e.Error(), status)
+	}
+	p.logRequest(rqp.IP, r.Method, rqp.URL, status, "", start, e)
+}
+
+// udpTarget returns the address in path, which follows the
+// default template of RFC 9298
+func udpTarget(path string) (addr string, e error) {
+	var ps []string
+	if strings.HasPrefix(path, udpPath) {
+		ps = strings.Split(strings.TrimPrefix(path, udpPath), "/")
+	}
+	if len(ps) < 2 || ps[0] == "" || ps[1] == "" ||
+		(len(ps) == 3 && ps[2] != "") || len(ps) > 3 {
+		e = malformedUDPTarget(path)
+	} else {
+		addr = net.JoinHostPort(ps[0], ps[1])
+	}
+	return
+}
+
+// relayDatagrams sends the UDP payloads read from dest in
+// datagrams of str, and writes to dest the ones received with
+// context ID 0, until the client ends str
+func relayDatagrams(str DatagramStream, dest net.Conn) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		bs, e := str.ReceiveDatagram(ctx)
+		for ; e == nil; bs, e = str.ReceiveDatagram(ctx) {
+			id, n, pe := parseVarint(bs)
+			// other contexts are unknown, thus dropped
+			if pe == nil && id == 0 {
+				dest.Write(bs[n:])
+			}
+		}
+	}()
+	go func() {
+		// capsules are unknown, thus skipped
+		io.Copy(ioutil.Discard, str)
+		cancel()
+		dest.Close()
+	}()
+	bs := make([]byte, 1<<16)
+	n, e := dest.Read(bs[1:])
+	for ; e == nil; n, e = dest.Read(bs[1:]) {
+		// context ID 0, as a variable length integer
+		bs[0] = 0
+		str.SendDatagram(bs[:n+1])
+	}
+	cancel()
+	str.Close()
+}
+
+// parseVarint returns the QUIC variable length integer
+// (RFC 9000) at the start of bs, and its length
+func parseVarint(bs []byte) (v uint64, n int, e error) {
+	if len(bs) != 0 {
+		n = 1 << (bs[0] >> 6)
+	}
+	if n == 0 || len(bs) < n {
+		e = io.ErrUnexpectedEOF
+	} else {
+		v = uint64(bs[0] & 0x3f)
+		for _, b := range bs[1:n] {
+			v = v<<8 | uint64(b)
+		}
+	}
+	return
+}
@@ -21,9 +21,11 @@
 package proxy
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/url"
+	"strings"
 	"time"
 
 	gp "golang.org/x/net/proxy"
@@ -43,6 +45,14 @@ type IfaceDialer struct {
 
 func (d *IfaceDialer) Dial(network, addr string) (n net.Conn,
 	e error) {
+	n, e = d.DialContext(context.Background(), network, addr)
+	return
+}
+
+// DialContext is like Dial, but gives up when ctx is done. It
+// implements the golang.org/x/proxy.ContextDialer interface
+func (d *IfaceDialer) DialContext(ctx context.Context, network,
+	addr string) (n net.Conn, e error) {
 	dlr := &net.Dialer{
 		Timeout: d.Timeout,
 	}
@@ -53,14 +63,16 @@ func (d *IfaceDialer) Dial(network, addr string) (n net.Conn,
 		if e == nil {
 			laddr, e = nf.Addrs()
 		}
-		if len(laddr) != 0 {
+		if len(laddr) != 0 && strings.HasPrefix(network, "udp") {
+			dlr.LocalAddr = &net.UDPAddr{IP: laddr[0].(*net.IPNet).IP}
+		} else if len(laddr) != 0 {
 			dlr.LocalAddr = &net.TCPAddr{IP: laddr[0].(*net.IPNet).IP}
 		} else {
 			e = &NoLocalIPErr{Interface: d.Interface}
 		}
 	}
 	if e == nil {
-		n, e = dlr.Dial(network, addr)
+		n, e = dlr.DialContext(ctx, network, addr)
 	}
 	return
 }
@@ -69,10 +81,86 @@ func (d *IfaceDialer) Dial(network, addr string) (n net.Conn,
 // using the supplied dialer
 func DialProxy(network, addr string, parentProxy *url.URL,
 	direct gp.Dialer) (n net.Conn, e error) {
+	n, e = DialProxyContext(context.Background(), network, addr,
+		parentProxy, direct)
+	return
+}
+
+// DialProxyContext is like DialProxy, but gives up when ctx is
+// done, including during the handshake with the parent proxy.
+// The context reaches direct when it implements
+// golang.org/x/proxy.ContextDialer
+func DialProxyContext(ctx context.Context, network, addr string,
+	parentProxy *url.URL, direct gp.Dialer) (n net.Conn, e error) {
+	registerDialers()
 	var d gp.Dialer
 	d, e = gp.FromURL(parentProxy, direct)
 	if e == nil {
-		n, e = d.Dial(network, addr)
+		n, e = dialContext(ctx, d, network, addr)
+	}
+	return
+}
+
+// dialContext dials with d.DialContext when available, and
+// otherwise with d.Dial, returning when ctx is done even if
+// the latter hasn't
+func dialContext(ctx context.Context, d gp.Dialer, network,
+	addr string) (n net.Conn, e error) {
+	if cd, ok := d.(gp.ContextDialer); ok {
+		n, e = cd.DialContext(ctx, network, addr)
+	} else {
+		type dialed struct {
+			n net.Conn
+			e error
+		}
+		r := make(chan dialed, 1)
+		go func() {
+			c, e := d.Dial(network, addr)
+			r <- dialed{n: c, e: e}
+		}()
+		select {
+		case res := <-r:
+			n, e = res.n, res.e
+		case <-ctx.Done():
+			e = ctx.Err()
+			go func() {
+				if res := <-r; res.n != nil {
+					res.n.Close()
+				}
+			}()
+		}
+	}
+	return
+}
+
+// watchContext makes the operations on c fail when ctx is
+// done, or past its deadline. The returned function stops
+// watching, restores c and returns ctx.Err() if it was done
+func watchContext(ctx context.Context, c net.Conn) (stop func() error) {
+	d, hasDeadline := ctx.Deadline()
+	if hasDeadline {
+		c.SetDeadline(d)
+	}
+	done, stopped := make(chan bool), make(chan bool)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// a time in the past interrupts blocked operations
+			c.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+		close(stopped)
+	}()
+	stop = func() (e error) {
+		close(done)
+		<-stopped
+		c.SetDeadline(time.Time{})
+		e = ctx.Err()
+		if e == nil && hasDeadline && !time.Now().Before(d) {
+			// c can reach the deadline before ctx is done
+			e = context.DeadlineExceeded
+		}
+		return
 	}
 	return
 }
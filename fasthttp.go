@@ -21,14 +21,15 @@
 package proxy
 
 import (
+	"bufio"
 	"context"
 	"io"
 	"net"
 	h "net/http"
 	"sync"
+	"time"
 
 	fh "github.com/valyala/fasthttp"
-	gp "golang.org/x/net/proxy"
 )
 
 // NewFastProxy creates a
@@ -36,12 +37,10 @@ import (
 // used as an HTTP/HTTPS proxy server, in conjunction with
 // a github.com/valyala/fasthttp.Server
 func NewFastProxy(dial Dialer) (p *Proxy) {
-	gp.RegisterDialerType("http", newHTTPProxy)
+	registerDialers()
 	p = &Proxy{
 		dialContext: dial,
-		fastCl: &fh.Client{
-			DialDualStack: true,
-		},
+		fastPool:    newFastPool(dial),
 	}
 	return
 }
@@ -50,16 +49,18 @@ func (p *Proxy) RequestHandler(ctx *fh.RequestCtx) {
 	i := &ReqParams{
 		Method: string(ctx.Request.Header.Method()),
 		URL:    string(ctx.URI().Host()),
+		User:   clientUser(ctx.TLSConnectionState()),
 	}
 	raddr := ctx.RemoteAddr().String()
 	i.IP, _, _ = net.SplitHostPort(raddr)
 	nctx := context.WithValue(ctx, ReqParamsK, i)
-	p.fastCl.Dial = func(addr string) (c net.Conn, e error) {
-		c, e = p.dialContext(nctx, "tcp", addr)
-		return
-	}
 	if ctx.IsConnect() {
-		dest, e := p.fastCl.Dial(i.URL)
+		e := middlewares(p.Middlewares).connect(i)
+		if e != nil {
+			ctx.Error(e.Error(), errStatus(e, h.StatusForbidden))
+			return
+		}
+		dest, e := p.dialContext(nctx, "tcp", i.URL)
 		if e == nil {
 			ctx.SetStatusCode(h.StatusOK)
 			ctx.Hijack(func(client net.Conn) {
@@ -78,9 +79,153 @@ func (p *Proxy) RequestHandler(ctx *fh.RequestCtx) {
 				ctx.Response.SetStatusCode(h.StatusServiceUnavailable)
 			}
 		}
+	} else if isUpgrade(
+		[]string{string(ctx.Request.Header.Peek("Connection"))},
+		string(ctx.Request.Header.Peek("Upgrade"))) {
+		p.fastUpgrade(ctx, nctx, i.IP)
 	} else {
-		copyFastHd(&ctx.Response.Header, &ctx.Request.Header)
-		p.fastCl.Do(&ctx.Request, &ctx.Response)
+		p.fastHTTP(ctx, nctx, i.IP)
+	}
+}
+
+// fastHTTP forwards the request in ctx, made by the client
+// with IP ip, like handleHTTPWith does with net/http. nctx
+// is the context for dialing
+func (p *Proxy) fastHTTP(ctx *fh.RequestCtx, nctx context.Context,
+	ip string) {
+	hd, hp := &ctx.Request.Header, p.headerPolicy()
+	loop := hp.forwardRequest(fastHd{hd}, false,
+		fastVersion(hd.IsHTTP11()), ip)
+	if loop {
+		ctx.Error(loopDetected().Error(), h.StatusLoopDetected)
+		return
+	}
+	start := time.Now()
+	rqp, _ := nctx.Value(ReqParamsK).(*ReqParams)
+	reqLimit, respLimit := p.Limits.limits(rqp)
+	req, resp := &ctx.Request, &ctx.Response
+	var method, uri string
+	// streamed means the response is logged after sending its
+	// body, which can be cut off
+	var streamed bool
+	t := &fastTrip{reqLimit: reqLimit, respLimit: respLimit}
+	if p.FastStream {
+		t.done = func(e error) {
+			if streamed {
+				p.logRequest(ip, method, uri, resp.StatusCode(), "",
+					start, e)
+			}
+		}
+	}
+	// reading the body of a streamed request would buffer it
+	size := int64(req.Header.ContentLength())
+	if !req.IsBodyStream() {
+		size = int64(len(req.Body()))
+	}
+	var e error
+	if reqLimit != 0 && size > reqLimit {
+		e = bodyTooLarge(reqLimit, false)
+	}
+	ms := middlewares(p.Middlewares)
+	var answered bool
+	var n int
+	if e == nil {
+		answered, n, e = ms.fastRequest(nctx, req, resp)
+	}
+	if e == nil && rqp != nil {
+		// the dialer decides about the destination the
+		// middlewares set
+		rqp.URL = string(req.URI().Host())
+	}
+	status := h.StatusForbidden
+	if e == nil && !answered {
+		status = h.StatusServiceUnavailable
+		e = p.fastPool.do(nctx, req, resp, t)
+		if e == nil {
+			hp.forwardResponse(fastHd{&resp.Header}, false,
+				fastVersion(resp.Header.IsHTTP11()))
+		}
+	}
+	if e == nil {
+		status = h.StatusBadGateway
+		e = ms.fastResponse(nctx, req, resp, n)
+	}
+	if e != nil {
+		ctx.Error(e.Error(), errStatus(e, status))
+	}
+	method, uri = string(req.Header.Method()), req.URI().String()
+	streamed = e == nil && resp.IsBodyStream()
+	if !streamed {
+		p.logRequest(ip, method, uri, resp.StatusCode(), "", start, e)
+	}
+}
+
+// fastUpgrade sends the upgrade request in ctx to its
+// destination, and when it answers 101 relays the connection
+// after sending that response to the client
+func (p *Proxy) fastUpgrade(ctx *fh.RequestCtx,
+	nctx context.Context, ip string) {
+	hd, hp := &ctx.Request.Header, p.headerPolicy()
+	loop := hp.forwardRequest(fastHd{hd}, true,
+		fastVersion(hd.IsHTTP11()), ip)
+	if loop {
+		ctx.Error(loopDetected().Error(), h.StatusLoopDetected)
+		return
+	}
+	ms := middlewares(p.Middlewares)
+	answered, n, e := ms.fastRequest(nctx, &ctx.Request,
+		&ctx.Response)
+	status, resp := h.StatusForbidden, &ctx.Response
+	var dest net.Conn
+	var br *bufio.Reader
+	if e == nil && !answered {
+		status, resp = h.StatusServiceUnavailable, new(fh.Response)
+		addr := hostWithPort(string(ctx.URI().Host()), ":80")
+		dest, e = p.dialContext(nctx, "tcp", addr)
+	}
+	if dest != nil {
+		bw := bufio.NewWriter(dest)
+		// the request URI is written in origin form, since
+		// ctx.URI() was parsed
+		e = ctx.Request.Write(bw)
+		if e == nil {
+			e = bw.Flush()
+		}
+		if e == nil {
+			br = bufio.NewReader(dest)
+			e = resp.Read(br)
+		}
+		if e == nil {
+			hp.forwardResponse(fastHd{&resp.Header},
+				resp.StatusCode() == h.StatusSwitchingProtocols,
+				fastVersion(resp.Header.IsHTTP11()))
+		}
+	}
+	if e == nil {
+		status = h.StatusBadGateway
+		e = ms.fastResponse(nctx, &ctx.Request, resp, n)
+	}
+	switching := e == nil && dest != nil &&
+		resp.StatusCode() == h.StatusSwitchingProtocols
+	if switching {
+		ctx.HijackSetNoResponse(true)
+		ctx.Hijack(func(client net.Conn) {
+			_, e := client.Write(resp.Header.Header())
+			if e == nil {
+				transWait(&peekedConn{Conn: dest, r: br}, client)
+			} else {
+				dest.Close()
+				client.Close()
+			}
+		})
+	} else if e == nil && dest != nil {
+		resp.CopyTo(&ctx.Response)
+		dest.Close()
+	} else if e != nil {
+		if dest != nil {
+			dest.Close()
+		}
+		ctx.Error(e.Error(), errStatus(e, status))
 	}
 }
 
@@ -93,14 +238,3 @@ func transWait(dest, src io.ReadWriteCloser) {
 	dest.Close()
 	src.Close()
 }
-
-func copyFastHd(resp *fh.ResponseHeader,
-	req *fh.RequestHeader) {
-	req.VisitAll(func(k, v []byte) {
-		ks := string(k)
-		ok := searchHopByHop(ks)
-		if !ok {
-			resp.Add(ks, string(v))
-		}
-	})
-}
@@ -0,0 +1,417 @@
+// Copyright © 2018-2019 Luis Ángel Méndez Gort
+
+// This file is part of Proxy.
+
+// Proxy is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General
+// Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your
+// option) any later version.
+
+// Proxy is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the
+// implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU Lesser General Public
+// License for more details.
+
+// You should have received a copy of the GNU Lesser General
+// Public License along with Proxy.  If not, see
+// <https://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	h "net/http"
+	"net/http/httputil"
+	"net/textproto"
+	"sync"
+	"time"
+
+	fh "github.com/valyala/fasthttp"
+)
+
+const (
+	// fastMaxIdle is the maximum of idle connections kept for
+	// a destination and client
+	fastMaxIdle = 8
+	// fastIdleTimeout is the time an idle connection is kept
+	fastIdleTimeout = 90 * time.Second
+)
+
+// fastPool sends the requests of the fasthttp front end,
+// keeping idle connections to their destinations. Connections
+// are dialed with the context of the request needing them,
+// and reused only for the same client, so the dialer decides
+// about every connection made on behalf of a client
+type fastPool struct {
+	dialContext Dialer
+	mtx         sync.Mutex
+	idle        map[string][]*idleConn
+}
+
+// fastConn is a connection to a destination
+type fastConn struct {
+	net.Conn
+	br *bufio.Reader
+	bw *bufio.Writer
+}
+
+type idleConn struct {
+	c     *fastConn
+	timer *time.Timer
+}
+
+func newFastPool(d Dialer) (p *fastPool) {
+	p = &fastPool{
+		dialContext: d,
+		idle:        make(map[string][]*idleConn),
+	}
+	return
+}
+
+// fastTrip has the options for sending a request of the
+// fasthttp front end
+type fastTrip struct {
+	// reqLimit and respLimit, when not 0, are the maximum sizes
+	// of the request and response bodies
+	reqLimit, respLimit int64
+	// done, when not nil, makes the response body a stream read
+	// from the destination while sending it to the client. It's
+	// called with the error that ended the stream, if any
+	done func(error)
+}
+
+// do sends req to the destination in its URI, reading the
+// response in resp. ctx has the *ReqParams of the request
+func (p *fastPool) do(ctx context.Context, req *fh.Request,
+	resp *fh.Response, t *fastTrip) (e error) {
+	uri := req.URI()
+	secure := string(uri.Scheme()) == "https"
+	addr := hostWithPort(string(uri.Host()), ":80")
+	if secure {
+		addr = hostWithPort(string(uri.Host()), ":443")
+	}
+	key := fastKey(ctx, addr, secure)
+	c := p.get(key)
+	reused := c != nil
+	if !reused {
+		c, e = p.dial(ctx, addr, secure)
+	}
+	var written, unanswered bool
+	if e == nil {
+		written, unanswered, e = c.roundTrip(req, resp, t)
+	}
+	// a streamed request body can't be sent again, and a
+	// request that may have been received is sent again only
+	// when it's idempotent
+	retry := reused && unanswered && !req.IsBodyStream() &&
+		(!written || idempotent(string(req.Header.Method())))
+	if e != nil && retry {
+		// the destination closed the idle connection
+		c.Close()
+		c, e = p.dial(ctx, addr, secure)
+		if e == nil {
+			_, _, e = c.roundTrip(req, resp, t)
+		}
+	}
+	if e == fh.ErrBodyTooLarge {
+		e = bodyTooLarge(t.respLimit, true)
+	}
+	if e == nil && t.done != nil {
+		e = p.stream(key, c, resp, t)
+		return
+	}
+	// a body without length ends when the connection closes
+	persists := e == nil && !resp.ConnectionClose() &&
+		resp.Header.ContentLength() != -2
+	if persists {
+		p.put(key, c)
+	} else if c != nil {
+		c.Close()
+	}
+	return
+}
+
+// stream sets as body of resp, whose header was read from c,
+// a stream reading the rest of it. c is kept as idle for key
+// after reading the body completely, when it persists
+func (p *fastPool) stream(key string, c *fastConn,
+	resp *fh.Response, t *fastTrip) (e error) {
+	n, status := int64(resp.Header.ContentLength()), resp.StatusCode()
+	persists := !resp.ConnectionClose() && n != -2
+	bodyless := resp.SkipBody || status < h.StatusOK ||
+		status == h.StatusNoContent || status == h.StatusNotModified
+	if bodyless || n == 0 {
+		if persists {
+			p.put(key, c)
+		} else {
+			c.Close()
+		}
+		return
+	}
+	if t.respLimit != 0 && n > t.respLimit {
+		c.Close()
+		e = bodyTooLarge(t.respLimit, true)
+		return
+	}
+	var body io.Reader = c.br
+	if n == -1 {
+		body = &chunkedBody{r: httputil.NewChunkedReader(c.br), br: c.br}
+	} else if n >= 0 {
+		body = io.LimitReader(c.br, n)
+	}
+	if t.respLimit != 0 && n < 0 {
+		body = &limitedBody{
+			ReadCloser: ioutil.NopCloser(body),
+			n:          t.respLimit,
+			err:        &BodyLimitErr{Limit: t.respLimit, Response: true},
+		}
+	}
+	fs := &fastStream{Reader: body}
+	fs.release = func(complete bool, e error) {
+		if complete && persists {
+			p.put(key, c)
+		} else {
+			c.Close()
+		}
+		t.done(e)
+	}
+	if n < 0 {
+		// the client gets it chunked
+		n = -1
+	}
+	resp.SetBodyStream(fs, int(n))
+	return
+}
+
+// fastStream is a response body read from a destination,
+// calling release when fasthttp closes it, after sending it
+// or discarding it
+type fastStream struct {
+	io.Reader
+	eof     bool
+	err     error
+	once    sync.Once
+	release func(complete bool, e error)
+}
+
+func (s *fastStream) Read(p []byte) (n int, e error) {
+	n, e = s.Reader.Read(p)
+	if e == io.EOF {
+		s.eof = true
+	} else if e != nil {
+		s.err = e
+	}
+	return
+}
+
+func (s *fastStream) Close() (e error) {
+	s.once.Do(func() { s.release(s.eof, s.err) })
+	return
+}
+
+// chunkedBody reads a chunked body, consuming its trailer
+// after the last chunk, so the connection can be reused
+type chunkedBody struct {
+	r    io.Reader
+	br   *bufio.Reader
+	done bool
+}
+
+func (b *chunkedBody) Read(p []byte) (n int, e error) {
+	if b.done {
+		e = io.EOF
+		return
+	}
+	n, e = b.r.Read(p)
+	if e == io.EOF {
+		b.done = true
+		if _, te := textproto.NewReader(b.br).ReadMIMEHeader(); te != nil {
+			e = te
+		}
+	}
+	return
+}
+
+// fastKey identifies the connections to addr that can be
+// reused by the client making the request in ctx
+func fastKey(ctx context.Context, addr string,
+	secure bool) (key string) {
+	key = addr
+	if secure {
+		key = "https://" + key
+	}
+	if rqp, ok := ctx.Value(ReqParamsK).(*ReqParams); ok {
+		key = rqp.IP + " " + rqp.User + " " + key
+	}
+	return
+}
+
+func (p *fastPool) dial(ctx context.Context, addr string,
+	secure bool) (c *fastConn, e error) {
+	var n net.Conn
+	n, e = p.dialContext(ctx, tcp, addr)
+	if e == nil && secure {
+		serverName, _, _ := net.SplitHostPort(addr)
+		tc := tls.Client(n, &tls.Config{ServerName: serverName})
+		if e = tc.Handshake(); e == nil {
+			n = tc
+		} else {
+			n.Close()
+		}
+	}
+	if e == nil {
+		c = &fastConn{
+			Conn: n,
+			br:   bufio.NewReader(n),
+			bw:   bufio.NewWriter(n),
+		}
+	}
+	return
+}
+
+// roundTrip writes req and reads resp. written is true when
+// req was sent completely, and unanswered when the connection
+// closed before the response started
+func (c *fastConn) roundTrip(req *fh.Request, resp *fh.Response,
+	t *fastTrip) (written, unanswered bool, e error) {
+	resp.Reset()
+	resp.SkipBody = req.Header.IsHead()
+	if t.reqLimit != 0 && req.IsBodyStream() &&
+		req.Header.ContentLength() < 0 {
+		e = writeLimited(c.bw, req, t.reqLimit)
+	} else {
+		// the request URI is written in origin form, since
+		// req.URI() was parsed
+		e = req.Write(c.bw)
+	}
+	if e == nil {
+		e = c.bw.Flush()
+	}
+	written, unanswered = e == nil, e != nil
+	if e == nil {
+		_, e = c.br.Peek(1)
+		unanswered = e != nil
+	}
+	if e == nil && t.done != nil {
+		e = resp.Header.Read(c.br)
+		// interim responses are skipped, like ReadLimitBody
+		// does with 100 Continue
+		for e == nil && interim(resp.StatusCode()) {
+			e = resp.Header.Read(c.br)
+		}
+	} else if e == nil {
+		e = resp.ReadLimitBody(c.br, int(t.respLimit))
+	}
+	return
+}
+
+// interim tells whether status is of an informational
+// response followed by the final one
+func interim(status int) (ok bool) {
+	ok = status >= 100 && status < 200 &&
+		status != h.StatusSwitchingProtocols
+	return
+}
+
+// idempotent tells whether a request with method can be sent
+// again without changing its effect
+func idempotent(method string) (ok bool) {
+	switch method {
+	case h.MethodGet, h.MethodHead, h.MethodOptions, h.MethodTrace,
+		h.MethodPut, h.MethodDelete:
+		ok = true
+	}
+	return
+}
+
+// writeLimited writes req, whose body is a stream of unknown
+// length, chunked and failing when it exceeds limit, like
+// fasthttp.Request.Write does
+func writeLimited(bw *bufio.Writer, req *fh.Request,
+	limit int64) (e error) {
+	uri := req.URI()
+	req.Header.SetHostBytes(uri.Host())
+	req.Header.SetRequestURIBytes(uri.RequestURI())
+	req.Header.SetContentLength(-1)
+	e = req.Header.Write(bw)
+	cw := httputil.NewChunkedWriter(bw)
+	if e == nil {
+		e = req.BodyWriteTo(&limitedWriter{
+			Writer: cw,
+			n:      limit,
+			err:    bodyTooLarge(limit, false),
+		})
+	}
+	if e == nil {
+		e = cw.Close()
+	}
+	if e == nil {
+		_, e = bw.WriteString("\r\n")
+	}
+	return
+}
+
+// get returns an idle connection for key, or nil
+func (p *fastPool) get(key string) (c *fastConn) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	cs := p.idle[key]
+	for c == nil && len(cs) != 0 {
+		ic := cs[len(cs)-1]
+		cs = cs[:len(cs)-1]
+		// a stopped timer means the connection is still idle
+		if ic.timer.Stop() {
+			c = ic.c
+		}
+	}
+	p.setIdle(key, cs)
+	return
+}
+
+// put keeps c as idle connection for key, closing it when
+// there are enough already or after fastIdleTimeout
+func (p *fastPool) put(key string, c *fastConn) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	cs := p.idle[key]
+	if len(cs) == fastMaxIdle {
+		c.Close()
+		return
+	}
+	ic := &idleConn{c: c}
+	ic.timer = time.AfterFunc(fastIdleTimeout, func() {
+		p.evict(key, ic)
+	})
+	p.idle[key] = append(cs, ic)
+}
+
+// evict closes ic and removes it from the idle connections
+// of key
+func (p *fastPool) evict(key string, ic *idleConn) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	cs := p.idle[key]
+	for i := range cs {
+		if cs[i] == ic {
+			cs = append(cs[:i], cs[i+1:]...)
+			break
+		}
+	}
+	p.setIdle(key, cs)
+	ic.c.Close()
+}
+
+func (p *fastPool) setIdle(key string, cs []*idleConn) {
+	if len(cs) == 0 {
+		delete(p.idle, key)
+	} else {
+		p.idle[key] = cs
+	}
+}
@@ -4,6 +4,7 @@ require (
 	github.com/lamg/algorithms v0.0.0-20190516184438-e8502d0eb72f
 	github.com/stretchr/testify v1.4.0
 	github.com/valyala/fasthttp v1.34.0
+	golang.org/x/crypto v0.0.0-20220214200702-86341886e292
 	golang.org/x/net v0.0.0-20220225172249-27dd8689420f
 )
 
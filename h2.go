@@ -0,0 +1,272 @@
+// Copyright © 2018-2019 Luis Ángel Méndez Gort
+
+// This file is part of Proxy.
+
+// Proxy is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General
+// Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your
+// option) any later version.
+
+// Proxy is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the
+// implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU Lesser General Public
+// License for more details.
+
+// You should have received a copy of the GNU Lesser General
+// Public License along with Proxy.  If not, see
+// <https://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"net"
+	h "net/http"
+	"sync"
+	"time"
+)
+
+// streamConn is a connection over the HTTP/2 or HTTP/3 stream
+// of a CONNECT request, which can't be hijacked. Reading it
+// reads the request body, and writing it writes the response
+// body
+type streamConn struct {
+	body    io.ReadCloser
+	w       h.ResponseWriter
+	flusher h.Flusher
+	local   net.Addr
+	remote  net.Addr
+	mtx     sync.Mutex
+	closed  bool
+	done    chan struct{}
+}
+
+// newStreamConn answers status to r, received through HTTP/2
+// or HTTP/3, and returns the connection over its stream
+func newStreamConn(w h.ResponseWriter, r *h.Request,
+	status int) (c *streamConn, e error) {
+	fl, ok := w.(h.Flusher)
+	if !ok {
+		e = noStreaming()
+	}
+	if e == nil {
+		c = &streamConn{
+			body:    r.Body,
+			w:       w,
+			flusher: fl,
+			remote:  streamAddr(r.RemoteAddr),
+			done:    make(chan struct{}),
+		}
+		c.local, ok = r.Context().Value(h.LocalAddrContextKey).(net.Addr)
+		if !ok {
+			c.local = streamAddr("")
+		}
+		// the server deadlines would interrupt the relay
+		c.SetDeadline(time.Time{})
+		w.WriteHeader(status)
+		fl.Flush()
+	}
+	return
+}
+
+// tunnelClient answers 200 to the CONNECT request r and
+// returns the connection with the client: the hijacked one
+// with HTTP/1, or the stream with later versions
+func tunnelClient(w h.ResponseWriter, r *h.Request) (c net.Conn,
+	e error) {
+	if r.ProtoMajor >= 2 {
+		c, e = newStreamConn(w, r, h.StatusOK)
+	} else {
+		hijacker, ok := w.(h.Hijacker)
+		if ok {
+			w.WriteHeader(h.StatusOK)
+			c, _, e = hijacker.Hijack()
+		} else {
+			e = noHijacking()
+		}
+	}
+	return
+}
+
+// relay copies dest to c and c to dest, returning when the
+// copy to c ends. The end of the request body half-closes
+// dest when possible, like END_STREAM does with the stream
+func (c *streamConn) relay(dest io.ReadWriteCloser) {
+	go func() {
+		_, e := io.Copy(dest, c)
+		cw, ok := dest.(interface{ CloseWrite() error })
+		if e != nil || !ok || cw.CloseWrite() != nil {
+			dest.Close()
+			c.Close()
+		}
+	}()
+	transfer(c, dest)
+}
+
+// wait returns when c is closed
+func (c *streamConn) wait() {
+	<-c.done
+}
+
+func (c *streamConn) Read(p []byte) (n int, e error) {
+	n, e = c.body.Read(p)
+	return
+}
+
+func (c *streamConn) Write(p []byte) (n int, e error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	// after closing the handler may have returned
+	if c.closed {
+		e = io.ErrClosedPipe
+	} else {
+		n, e = c.w.Write(p)
+	}
+	if e == nil {
+		c.flusher.Flush()
+	}
+	return
+}
+
+func (c *streamConn) Close() (e error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if !c.closed {
+		c.closed = true
+		e = c.body.Close()
+		close(c.done)
+	}
+	return
+}
+
+func (c *streamConn) LocalAddr() net.Addr { return c.local }
+
+func (c *streamConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *streamConn) SetDeadline(t time.Time) (e error) {
+	e = c.SetReadDeadline(t)
+	if e == nil {
+		e = c.SetWriteDeadline(t)
+	}
+	return
+}
+
+// deadliner is implemented by the net/http HTTP/2 response
+// writers since Go 1.20 (see streamDeadlines), and the quic-go
+// ones
+type deadliner interface {
+	SetReadDeadline(time.Time) error
+	SetWriteDeadline(time.Time) error
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) (e error) {
+	if d, ok := c.w.(deadliner); ok {
+		e = d.SetReadDeadline(t)
+	}
+	return
+}
+
+func (c *streamConn) SetWriteDeadline(t time.Time) (e error) {
+	if d, ok := c.w.(deadliner); ok {
+		e = d.SetWriteDeadline(t)
+	}
+	return
+}
+
+// streamAddr is the address of an end of a stream
+type streamAddr string
+
+func (a streamAddr) Network() string { return "tcp" }
+
+func (a streamAddr) String() string { return string(a) }
+
+// handleExtendedConnect relays the extended CONNECT request r
+// (RFC 8441 and 9220), bootstrapping protocol over its stream,
+// as an HTTP/1.1 upgrade request to the destination. Since
+// the server drops :scheme, https is assumed for the port 443
+func (p *Proxy) handleExtendedConnect(w h.ResponseWriter,
+	r *h.Request, protocol string) {
+	start := time.Now()
+	rqp, _ := r.Context().Value(ReqParamsK).(*ReqParams)
+	ms := middlewares(p.Middlewares)
+	e := ms.connect(rqp)
+	status := errStatus(e, h.StatusForbidden)
+	req := upgradeRequest(r, protocol)
+	hp := p.headerPolicy()
+	if e == nil && hp.forwardRequest(stdHeader(req.Header), true,
+		stdVersion(r.ProtoMajor, r.ProtoMinor), rqp.IP) {
+		e, status = loopDetected(), h.StatusLoopDetected
+	}
+	var resp *h.Response
+	if e == nil {
+		trans := p.trans
+		if p.Pool != nil {
+			trans = p.Pool.transport(trans, rqp)
+		}
+		resp, e = trans.RoundTrip(req)
+		status = h.StatusServiceUnavailable
+	}
+	if e == nil {
+		hp.forwardResponse(stdHeader(resp.Header), false,
+			stdVersion(resp.ProtoMajor, resp.ProtoMinor))
+		resp.Header.Del("Sec-WebSocket-Accept")
+	}
+	if e == nil && resp.StatusCode == h.StatusSwitchingProtocols {
+		status = h.StatusOK
+		copyHeader(w.Header(), resp.Header)
+		var c *streamConn
+		c, e = newStreamConn(w, r, status)
+		if e == nil {
+			c.relay(resp.Body.(io.ReadWriteCloser))
+		} else {
+			resp.Body.Close()
+			status = h.StatusInternalServerError
+		}
+	} else if e == nil && resp.StatusCode/100 == 2 {
+		// the client would take it as the tunnel established
+		resp.Body.Close()
+		e, status = notSwitched(resp.StatusCode), h.StatusBadGateway
+	} else if e == nil {
+		status = resp.StatusCode
+		copyHeader(w.Header(), resp.Header)
+		w.WriteHeader(status)
+		io.Copy(w, resp.Body)
+		resp.Body.Close()
+	}
+	if e != nil {
+		h.Error(w, e.Error(), status)
+	}
+	p.logRequest(rqp.IP, r.Method, req.URL.String(), status, "",
+		start, e)
+}
+
+// upgradeRequest returns the HTTP/1.1 request switching to
+// protocol that corresponds to the extended CONNECT request r
+func upgradeRequest(r *h.Request, protocol string) (req *h.Request) {
+	req = r.Clone(r.Context())
+	req.Method = h.MethodGet
+	req.URL.Scheme, req.URL.Host = "http", r.Host
+	if req.URL.Port() == "443" {
+		req.URL.Scheme = "https"
+	}
+	req.Body, req.ContentLength = h.NoBody, 0
+	delete(req.Header, ":protocol")
+	if _, ok := req.Header["User-Agent"]; !ok {
+		// keeps the transport from adding its own
+		req.Header.Set("User-Agent", "")
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", protocol)
+	if protocol == "websocket" {
+		// RFC 8441 drops the handshake key of RFC 6455
+		key := make([]byte, 16)
+		rand.Read(key)
+		req.Header.Set("Sec-WebSocket-Key",
+			base64.StdEncoding.EncodeToString(key))
+	}
+	return
+}
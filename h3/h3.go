@@ -0,0 +1,80 @@
+// Copyright © 2018-2019 Luis Ángel Méndez Gort
+
+// This file is part of Proxy.
+
+// Proxy is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General
+// Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your
+// option) any later version.
+
+// Proxy is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the
+// implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU Lesser General Public
+// License for more details.
+
+// You should have received a copy of the GNU Lesser General
+// Public License along with Proxy.  If not, see
+// <https://www.gnu.org/licenses/>.
+
+// Package h3 serves a proxy.Proxy with HTTP/3. It's a module
+// apart from github.com/lamg/proxy since quic-go needs a
+// recent Go, while the proxy package builds with Go 1.13
+package h3
+
+import (
+	"crypto/tls"
+	"net"
+	h "net/http"
+
+	"github.com/lamg/proxy"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// Serve serves HTTP/3 with p on the QUIC connections arriving
+// at pc, with the TLS configuration c. Besides what
+// p.ServeHTTP does, it relays UDP with CONNECT-UDP
+// (RFC 9298), dialing with the "udp" network. The proxy must
+// be created with proxy.NewProxy
+func Serve(p *proxy.Proxy, pc net.PacketConn, c *tls.Config) (e error) {
+	srv := &http3.Server{
+		Handler:         handler(p),
+		TLSConfig:       http3.ConfigureTLSConfig(c),
+		EnableDatagrams: true,
+	}
+	e = srv.Serve(pc)
+	return
+}
+
+// handler passes the requests to p.ServeHTTP, with the
+// protocol of an extended CONNECT, that quic-go has as
+// r.Proto, where net/http has it for HTTP/2
+func handler(p *proxy.Proxy) h.Handler {
+	return h.HandlerFunc(func(w h.ResponseWriter, r *h.Request) {
+		if r.Method == h.MethodConnect && r.Proto != "HTTP/3.0" {
+			r.Header.Set(":protocol", r.Proto)
+			r.Proto = "HTTP/3.0"
+		}
+		str, ok := w.(http3.HTTPStreamer)
+		if ok && r.Header.Get(":protocol") == "connect-udp" {
+			w = &datagramWriter{ResponseWriter: w, str: str}
+		}
+		p.ServeHTTP(w, r)
+	})
+}
+
+// datagramWriter is a response writer whose request stream
+// carries HTTP datagrams
+type datagramWriter struct {
+	h.ResponseWriter
+	str http3.HTTPStreamer
+}
+
+func (w *datagramWriter) Flush() {
+	w.ResponseWriter.(h.Flusher).Flush()
+}
+
+func (w *datagramWriter) DatagramStream() proxy.DatagramStream {
+	return w.str.HTTPStream()
+}
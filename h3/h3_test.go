@@ -0,0 +1,221 @@
+// Copyright © 2018-2019 Luis Ángel Méndez Gort
+
+// This file is part of Proxy.
+
+// Proxy is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General
+// Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your
+// option) any later version.
+
+// Proxy is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the
+// implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU Lesser General Public
+// License for more details.
+
+// You should have received a copy of the GNU Lesser General
+// Public License along with Proxy.  If not, see
+// <https://www.gnu.org/licenses/>.
+
+package h3
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	h "net/http"
+	ht "net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/lamg/proxy"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/stretchr/testify/require"
+)
+
+const udpPath = "/.well-known/masque/udp/"
+
+func TestHTTP3(t *testing.T) {
+	ca := newTestCA(t)
+	caLeaf, _ := x509.ParseCertificate(ca.Certificate[0])
+	roots := x509.NewCertPool()
+	roots.AddCert(caLeaf)
+	echo := listenEcho(t)
+	defer echo.Close()
+	udpEcho, e := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, e)
+	defer udpEcho.Close()
+	go func() {
+		bs := make([]byte, 1500)
+		n, addr, e := udpEcho.ReadFrom(bs)
+		for ; e == nil; n, addr, e = udpEcho.ReadFrom(bs) {
+			udpEcho.WriteTo(bs[:n], addr)
+		}
+	}()
+	origin := ht.NewServer(h.HandlerFunc(func(w h.ResponseWriter,
+		r *h.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer origin.Close()
+	dials := make(chan *proxy.ReqParams, 1)
+	p := proxy.NewProxy(func(ctx context.Context, n, a string) (net.Conn,
+		error) {
+		if n == "udp" {
+			dials <- ctx.Value(proxy.ReqParamsK).(*proxy.ReqParams)
+		}
+		return new(net.Dialer).DialContext(ctx, n, a)
+	})
+	pc, e := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, e)
+	defer pc.Close()
+	go Serve(p, pc, &tls.Config{
+		Certificates: []tls.Certificate{
+			issueCert(t, ca, "127.0.0.1"),
+		},
+	})
+	proxyAddr := pc.LocalAddr().String()
+	tlsConf := &tls.Config{
+		RootCAs:    roots,
+		NextProtos: []string{http3.NextProtoH3},
+	}
+	trans := &http3.Transport{TLSClientConfig: tlsConf,
+		EnableDatagrams: true}
+	defer trans.Close()
+
+	// plain requests have the destination in :authority
+	req, e := h.NewRequest(h.MethodGet, "https://"+proxyAddr+"/", nil)
+	require.NoError(t, e)
+	req.Host = origin.Listener.Addr().String()
+	resp, e := trans.RoundTrip(req)
+	require.NoError(t, e)
+	bs, e := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, e)
+	require.Equal(t, "hello", string(bs))
+
+	// tunnel relayed through the stream
+	pr, pw := io.Pipe()
+	req, e = h.NewRequest(h.MethodConnect, "https://"+proxyAddr, pr)
+	require.NoError(t, e)
+	req.Host = echo.Addr().String()
+	resp, e = trans.RoundTrip(req)
+	require.NoError(t, e)
+	require.Equal(t, h.StatusOK, resp.StatusCode)
+	_, e = io.WriteString(pw, "bla")
+	require.NoError(t, e)
+	bs = make([]byte, 3)
+	_, e = io.ReadFull(resp.Body, bs)
+	require.NoError(t, e)
+	require.Equal(t, "bla", string(bs))
+	pw.Close()
+	resp.Body.Close()
+
+	// UDP relayed in datagrams
+	ctx, cancel := context.WithTimeout(context.Background(),
+		5*time.Second)
+	defer cancel()
+	qc, e := quic.DialAddr(ctx, proxyAddr, tlsConf,
+		&quic.Config{EnableDatagrams: true})
+	require.NoError(t, e)
+	cc := trans.NewClientConn(qc)
+	_, udpPort, _ := net.SplitHostPort(udpEcho.LocalAddr().String())
+	for _, path := range []string{
+		udpPath + "127.0.0.1/" + udpPort + "/",
+		udpPath + "127.0.0.1/",
+	} {
+		str, e := cc.OpenRequestStream(ctx)
+		require.NoError(t, e)
+		u, _ := url.Parse("https://" + proxyAddr + path)
+		e = str.SendRequestHeader((&h.Request{
+			Method: h.MethodConnect,
+			Proto:  "connect-udp",
+			Host:   proxyAddr,
+			URL:    u,
+			Header: h.Header{"Capsule-Protocol": {"?1"}},
+		}).WithContext(ctx))
+		require.NoError(t, e)
+		resp, e := str.ReadResponse()
+		require.NoError(t, e)
+		if path == udpPath+"127.0.0.1/" {
+			require.Equal(t, h.StatusBadRequest, resp.StatusCode)
+			str.Close()
+			continue
+		}
+		require.Equal(t, h.StatusOK, resp.StatusCode)
+		require.Equal(t, "?1", resp.Header.Get("Capsule-Protocol"))
+		rqp := <-dials
+		require.Equal(t, "connect-udp", rqp.Protocol)
+		require.Equal(t, "127.0.0.1:"+udpPort, rqp.URL)
+		// datagrams of unknown contexts are dropped
+		require.NoError(t, str.SendDatagram([]byte("\x01bla")))
+		require.NoError(t, str.SendDatagram([]byte("\x00blabla")))
+		bs, e := str.ReceiveDatagram(ctx)
+		require.NoError(t, e)
+		require.Equal(t, "\x00blabla", string(bs))
+		str.Close()
+	}
+	qc.CloseWithError(0, "")
+}
+
+func newTestCA(t *testing.T) (ca tls.Certificate) {
+	key, e := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, e)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Proxy test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, e := x509.CreateCertificate(rand.Reader, tmpl, tmpl,
+		key.Public(), key)
+	require.NoError(t, e)
+	ca = tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return
+}
+
+func issueCert(t *testing.T, ca tls.Certificate,
+	ip string) (c tls.Certificate) {
+	caLeaf, e := x509.ParseCertificate(ca.Certificate[0])
+	require.NoError(t, e)
+	key, e := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, e)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: ip},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP(ip)},
+	}
+	der, e := x509.CreateCertificate(rand.Reader, tmpl, caLeaf,
+		key.Public(), ca.PrivateKey)
+	require.NoError(t, e)
+	c = tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return
+}
+
+func listenEcho(t *testing.T) (l net.Listener) {
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, e)
+	go func() {
+		for c, e := l.Accept(); e == nil; c, e = l.Accept() {
+			go func(c net.Conn) { io.Copy(c, c); c.Close() }(c)
+		}
+	}()
+	return
+}
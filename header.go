@@ -0,0 +1,246 @@
+// Copyright © 2018-2019 Luis Ángel Méndez Gort
+
+// This file is part of Proxy.
+
+// Proxy is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General
+// Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your
+// option) any later version.
+
+// Proxy is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the
+// implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU Lesser General Public
+// License for more details.
+
+// You should have received a copy of the GNU Lesser General
+// Public License along with Proxy.  If not, see
+// <https://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	h "net/http"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// header is implemented by adapters of the net/http and
+// fasthttp headers, for processing them the same way in both
+// front ends. Names are canonical
+type header interface {
+	values(k string) []string
+	set(k, v string)
+	del(k string)
+}
+
+// hopByHop are the headers meaningful only for a single
+// connection (RFC 7230 section 6.1), besides those listed in
+// Connection. Proxy-Connection is sent by some clients instead
+// of Connection
+var hopByHop = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate",
+	"Proxy-Authorization", "Proxy-Connection", "Te", "Trailer",
+	"Transfer-Encoding", "Upgrade",
+}
+
+// removeHopByHop deletes from hd the hop-by-hop headers. When
+// upgrade is true the Connection and Upgrade headers are kept,
+// with the latter as the only Connection option
+func removeHopByHop(hd header, upgrade bool) {
+	up := hd.values("Upgrade")
+	for _, v := range hd.values("Connection") {
+		for _, t := range strings.Split(v, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				hd.del(textproto.CanonicalMIMEHeaderKey(t))
+			}
+		}
+	}
+	for _, k := range hopByHop {
+		hd.del(k)
+	}
+	if upgrade && len(up) != 0 {
+		hd.set("Connection", "Upgrade")
+		hd.set("Upgrade", strings.Join(up, ", "))
+	}
+}
+
+// HeaderPolicy decides the headers telling the next hop that
+// a message was proxied, and for whom
+type HeaderPolicy struct {
+	// Pseudonym identifies the proxy in Via, and detects
+	// loops when a request has it already. When empty the
+	// host name with a random suffix is used, which differs
+	// between policies, thus between proxies chained in the
+	// same host
+	Pseudonym string
+	// XForwardedFor appends the client IP to
+	// X-Forwarded-For in requests
+	XForwardedFor bool
+	// Forwarded appends an element with the client IP to
+	// Forwarded (RFC 7239) in requests
+	Forwarded bool
+	// Anonymous removes Via, X-Forwarded-For and Forwarded
+	// from requests and responses, instead of adding them
+	Anonymous bool
+
+	once      sync.Once
+	generated string
+}
+
+func (p *HeaderPolicy) pseudonym() (s string) {
+	s = p.Pseudonym
+	if s == "" {
+		p.once.Do(func() { p.generated = newPseudonym() })
+		s = p.generated
+	}
+	return
+}
+
+// newPseudonym returns the host name followed by a random
+// suffix
+func newPseudonym() (s string) {
+	s, e := os.Hostname()
+	if e != nil || s == "" {
+		s = "proxy"
+	}
+	bs := make([]byte, 4)
+	rand.Read(bs)
+	s += "-" + hex.EncodeToString(bs)
+	return
+}
+
+// forwardRequest prepares the headers of a request received
+// with protocol version proto (like "1.1") from the client
+// with IP ip, for sending it to the next hop. It returns
+// whether the request passed through the proxy already
+func (p *HeaderPolicy) forwardRequest(hd header, upgrade bool,
+	proto, ip string) (loop bool) {
+	removeHopByHop(hd, upgrade)
+	loop = !p.Anonymous && p.visited(hd)
+	if p.Anonymous {
+		hd.del("Via")
+		hd.del("X-Forwarded-For")
+		hd.del("Forwarded")
+	} else {
+		if p.XForwardedFor && ip != "" {
+			appendValue(hd, "X-Forwarded-For", ip)
+		}
+		if p.Forwarded && ip != "" {
+			appendValue(hd, "Forwarded", forwardedFor(ip))
+		}
+		appendValue(hd, "Via", proto+" "+p.pseudonym())
+	}
+	return
+}
+
+// forwardResponse is like forwardRequest, for responses
+func (p *HeaderPolicy) forwardResponse(hd header, upgrade bool,
+	proto string) {
+	removeHopByHop(hd, upgrade)
+	if p.Anonymous {
+		hd.del("Via")
+	} else {
+		appendValue(hd, "Via", proto+" "+p.pseudonym())
+	}
+}
+
+// visited returns whether an element of the Via header in hd
+// was received by the proxy
+func (p *HeaderPolicy) visited(hd header) (ok bool) {
+	var vias []string
+	for _, v := range hd.values("Via") {
+		vias = append(vias, splitQuoted(v, ',')...)
+	}
+	for i := 0; !ok && i != len(vias); i++ {
+		// protocol, received-by and optionally a comment
+		fs := strings.Fields(vias[i])
+		ok = len(fs) >= 2 && strings.EqualFold(fs[1], p.pseudonym())
+	}
+	return
+}
+
+// forwardedFor returns the Forwarded element for the client
+// with IP ip
+func forwardedFor(ip string) (el string) {
+	el = "for=" + ip
+	if strings.Contains(ip, ":") {
+		// IPv6 addresses are bracketed and quoted
+		el = "for=\"[" + ip + "]\""
+	}
+	return
+}
+
+// appendValue adds v to the comma separated list in the k
+// header
+func appendValue(hd header, k, v string) {
+	hd.set(k, strings.Join(append(hd.values(k), v), ", "))
+}
+
+type stdHeader h.Header
+
+func (s stdHeader) values(k string) (vs []string) {
+	vs = s[k]
+	return
+}
+
+func (s stdHeader) set(k, v string) {
+	h.Header(s).Set(k, v)
+}
+
+func (s stdHeader) del(k string) {
+	h.Header(s).Del(k)
+}
+
+// fastHeader is implemented by
+// github.com/valyala/fasthttp.RequestHeader and
+// github.com/valyala/fasthttp.ResponseHeader
+type fastHeader interface {
+	VisitAll(func(k, v []byte))
+	Set(k, v string)
+	Del(k string)
+}
+
+type fastHd struct {
+	fastHeader
+}
+
+func (f fastHd) values(k string) (vs []string) {
+	f.VisitAll(func(key, value []byte) {
+		if strings.EqualFold(string(key), k) {
+			vs = append(vs, string(value))
+		}
+	})
+	return
+}
+
+func (f fastHd) set(k, v string) {
+	f.Set(k, v)
+}
+
+func (f fastHd) del(k string) {
+	f.Del(k)
+}
+
+// stdVersion returns the version for the Via header of
+// net/http messages
+func stdVersion(major, minor int) (v string) {
+	v = strconv.Itoa(major) + "." + strconv.Itoa(minor)
+	return
+}
+
+// fastVersion returns the version for the Via header of
+// fasthttp messages
+func fastVersion(http11 bool) (v string) {
+	v = "1.0"
+	if http11 {
+		v = "1.1"
+	}
+	return
+}
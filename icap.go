@@ -0,0 +1,603 @@
+// Copyright © 2018-2019 Luis Ángel Méndez Gort
+
+// This file is part of Proxy.
+
+// Proxy is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General
+// Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your
+// option) any later version.
+
+// Proxy is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the
+// implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU Lesser General Public
+// License for more details.
+
+// You should have received a copy of the GNU Lesser General
+// Public License along with Proxy.  If not, see
+// <https://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	h "net/http"
+	"net/http/httputil"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ICAP sends the requests and responses of the net/http
+// front end to an ICAP server (RFC 3507) for adapting them,
+// like an antivirus or a content filter does. It works as the
+// Middleware returned by its method with that name, which has
+// no functions for the fasthttp front end, so the messages of
+// the latter aren't adapted
+type ICAP struct {
+	// ReqMod and RespMod are the icap:// URLs of the REQMOD and
+	// RESPMOD services. An empty one disables its service
+	ReqMod, RespMod string
+	// Preview, when positive, is the amount of body bytes sent
+	// before knowing whether the server needs the rest
+	Preview int
+	// FailOpen makes the messages be forwarded unmodified when
+	// the server fails. Otherwise the client gets 503 Service
+	// Unavailable
+	FailOpen bool
+	// Bypass are the destination domains whose messages aren't
+	// sent to the server
+	Bypass []string
+	// Timeout, when not 0, bounds the time for dialing the
+	// server, and for each read and write on the connection
+	Timeout time.Duration
+	// ReplayLimit is the amount of body bytes kept for
+	// forwarding the body when the server doesn't modify it,
+	// DefaultReplayLimit when 0. The server can answer without
+	// modifications after the preview, or after the complete
+	// body when it's smaller than the limit
+	ReplayLimit int64
+}
+
+// DefaultReplayLimit is the ReplayLimit of an ICAP when not set
+const DefaultReplayLimit = 1 << 20
+
+// ICAPErr is the error of an ICAP server answering with an
+// unexpected status
+type ICAPErr struct {
+	Service string
+	Status  int
+}
+
+func (e *ICAPErr) Error() (s string) {
+	s = fmt.Sprintf("ICAP service '%s' answered %d", e.Service,
+		e.Status)
+	return
+}
+
+// Middleware returns a middleware sending the requests and
+// responses to the configured services
+func (c *ICAP) Middleware() (m *Middleware) {
+	m = &Middleware{Request: c.request, Response: c.response}
+	return
+}
+
+// request sends req to the REQMOD service, modifying it as
+// answered, or answering it when the service does
+func (c *ICAP) request(req *h.Request) (resp *h.Response, e error) {
+	if c.ReqMod == "" || matchDomains(c.Bypass, req.URL.Hostname()) {
+		return
+	}
+	var body *recordedBody
+	if req.Body != nil && req.Body != h.NoBody {
+		body = c.recorded(req.Body, req.ContentLength)
+	}
+	var r *icapResponse
+	r, e = c.exchange(req.Context(), "REQMOD", c.ReqMod,
+		[]icapSection{{"req-hdr", requestHeader(req)}}, "req-body",
+		body)
+	adapted := e == nil && r.adapted()
+	if adapted && body != nil {
+		body.Close()
+	}
+	if adapted && r.resp != nil {
+		resp = r.resp
+	} else if adapted {
+		modifyRequest(req, r.req)
+	} else if e == nil {
+		e = r.unmodified(c.ReqMod)
+	}
+	var lost bool
+	if !adapted && body != nil && (e == nil || c.FailOpen) {
+		req.Body, lost = body.replay()
+	}
+	e = c.failure(e)
+	if lost {
+		e = &HTTPErr{Status: h.StatusBadGateway, Err: notReplayed(c.ReqMod)}
+	}
+	return
+}
+
+// response sends resp to the RESPMOD service, modifying it as
+// answered
+func (c *ICAP) response(resp *h.Response) (e error) {
+	req := resp.Request
+	if c.RespMod == "" ||
+		resp.StatusCode == h.StatusSwitchingProtocols ||
+		matchDomains(c.Bypass, req.URL.Hostname()) {
+		return
+	}
+	var body *recordedBody
+	if resp.Body != nil && resp.Body != h.NoBody {
+		body = c.recorded(resp.Body, resp.ContentLength)
+	}
+	var r *icapResponse
+	r, e = c.exchange(req.Context(), "RESPMOD", c.RespMod,
+		[]icapSection{
+			{"req-hdr", requestHeader(req)},
+			{"res-hdr", responseHeader(resp)},
+		}, "res-body", body)
+	adapted := e == nil && r.adapted() && r.resp != nil
+	if adapted {
+		if body != nil {
+			body.Close()
+		}
+		resp.Status, resp.StatusCode = r.resp.Status, r.resp.StatusCode
+		resp.Header, resp.Body = r.resp.Header, r.resp.Body
+		resp.ContentLength = r.resp.ContentLength
+	} else if e == nil {
+		e = r.unmodified(c.RespMod)
+	}
+	var lost bool
+	if !adapted && body != nil && (e == nil || c.FailOpen) {
+		resp.Body, lost = body.replay()
+	}
+	e = c.failure(e)
+	if lost {
+		e = &HTTPErr{Status: h.StatusBadGateway, Err: notReplayed(c.RespMod)}
+	}
+	return
+}
+
+// recorded returns body, of length n or -1 when unknown,
+// recording its first ReplayLimit bytes
+func (c *ICAP) recorded(body io.ReadCloser, n int64) (r *recordedBody) {
+	r = &recordedBody{
+		ReadCloser: body,
+		length:     n,
+		limit:      c.ReplayLimit,
+		preview:    c.Preview > 0,
+	}
+	if r.limit == 0 {
+		r.limit = DefaultReplayLimit
+	}
+	return
+}
+
+// failure returns the error for the client when e isn't nil,
+// according the fail policy
+func (c *ICAP) failure(e error) (r error) {
+	if e != nil && !c.FailOpen {
+		r = &HTTPErr{Status: h.StatusServiceUnavailable, Err: e}
+	}
+	return
+}
+
+const (
+	icapContinue  = 100
+	icapOK        = 200
+	icapNoContent = 204
+)
+
+// icapSection is an encapsulated header block
+type icapSection struct {
+	name  string
+	block []byte
+}
+
+// icapResponse is the answer of an ICAP server, with the
+// encapsulated HTTP request or response, if any
+type icapResponse struct {
+	status int
+	req    *h.Request
+	resp   *h.Response
+	conn   net.Conn
+}
+
+// adapted returns whether r has an adapted message
+func (r *icapResponse) adapted() (ok bool) {
+	ok = r.status == icapOK && (r.req != nil || r.resp != nil)
+	return
+}
+
+// unmodified closes r, returning an error unless it's 204 No
+// Content
+func (r *icapResponse) unmodified(service string) (e error) {
+	r.close()
+	if r.status != icapNoContent {
+		e = &ICAPErr{Service: service, Status: r.status}
+	}
+	return
+}
+
+func (r *icapResponse) close() {
+	if r.req != nil {
+		r.req.Body.Close()
+	} else if r.resp != nil {
+		r.resp.Body.Close()
+	} else {
+		r.conn.Close()
+	}
+}
+
+// exchange sends an ICAP request to service, with sections
+// encapsulated, followed by body as bodyName when not nil,
+// and reads the response
+func (c *ICAP) exchange(ctx context.Context, method,
+	service string, sections []icapSection, bodyName string,
+	body *recordedBody) (r *icapResponse, e error) {
+	var u *url.URL
+	u, e = url.Parse(service)
+	var conn net.Conn
+	if e == nil {
+		d := &net.Dialer{Timeout: c.Timeout}
+		conn, e = d.DialContext(ctx, tcp, hostWithPort(u.Host, ":1344"))
+	}
+	if e != nil {
+		return
+	}
+	if c.Timeout != 0 {
+		conn = &timeoutConn{Conn: conn, timeout: c.Timeout}
+	}
+	bw, br := bufio.NewWriter(conn), bufio.NewReader(conn)
+	var encapsulated []string
+	offset := 0
+	for _, s := range sections {
+		encapsulated = append(encapsulated,
+			s.name+"="+strconv.Itoa(offset))
+		offset += len(s.block)
+	}
+	if body != nil {
+		encapsulated = append(encapsulated,
+			bodyName+"="+strconv.Itoa(offset))
+	} else {
+		encapsulated = append(encapsulated,
+			"null-body="+strconv.Itoa(offset))
+	}
+	fmt.Fprintf(bw, "%s %s ICAP/1.0\r\nHost: %s\r\n", method,
+		service, u.Host)
+	// without it the server answers 204 only to the preview
+	if body == nil || body.replayable() {
+		bw.WriteString("Allow: 204\r\n")
+	}
+	if body != nil && c.Preview > 0 {
+		fmt.Fprintf(bw, "Preview: %d\r\n", c.Preview)
+	}
+	if rqp, ok := ctx.Value(ReqParamsK).(*ReqParams); ok {
+		fmt.Fprintf(bw, "X-Client-IP: %s\r\n", rqp.IP)
+	}
+	fmt.Fprintf(bw, "Encapsulated: %s\r\n\r\n",
+		strings.Join(encapsulated, ", "))
+	for _, s := range sections {
+		bw.Write(s.block)
+	}
+	r = &icapResponse{conn: conn}
+	if body != nil && c.Preview > 0 {
+		preview := make([]byte, c.Preview)
+		var n int
+		n, e = io.ReadFull(body, preview)
+		complete := e == io.EOF || e == io.ErrUnexpectedEOF
+		if e == nil || complete {
+			writeChunk(bw, preview[:n])
+			if complete {
+				bw.WriteString("0; ieof\r\n\r\n")
+			} else {
+				bw.WriteString("0\r\n\r\n")
+			}
+			e = bw.Flush()
+		}
+		if e == nil {
+			r.status, e = readICAPStatus(br)
+		}
+		if e == nil {
+			body.previewed()
+		}
+		if e == nil && r.status == icapContinue && !complete {
+			e = writeChunks(bw, body)
+		} else if e == nil && r.status == icapContinue {
+			e = fmt.Errorf("ICAP service '%s' continued after "+
+				"the complete body", service)
+		}
+	} else if body != nil {
+		e = writeChunks(bw, body)
+	} else {
+		e = bw.Flush()
+	}
+	if e == nil && (r.status == 0 || r.status == icapContinue) {
+		r.status, e = readICAPStatus(br)
+	}
+	if e == nil {
+		e = r.read(br)
+	}
+	if e != nil {
+		conn.Close()
+		r = nil
+	}
+	return
+}
+
+// timeoutConn bounds each read and write by timeout
+type timeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *timeoutConn) Read(p []byte) (n int, e error) {
+	e = c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	if e == nil {
+		n, e = c.Conn.Read(p)
+	}
+	return
+}
+
+func (c *timeoutConn) Write(p []byte) (n int, e error) {
+	e = c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	if e == nil {
+		n, e = c.Conn.Write(p)
+	}
+	return
+}
+
+// writeChunks sends the content of body in chunks, ended by
+// the last one
+func writeChunks(bw *bufio.Writer, body io.Reader) (e error) {
+	buf := make([]byte, 32*1024)
+	var n int
+	for e == nil {
+		n, e = body.Read(buf)
+		if n != 0 {
+			writeChunk(bw, buf[:n])
+		}
+	}
+	if e == io.EOF {
+		bw.WriteString("0\r\n\r\n")
+		e = bw.Flush()
+	}
+	return
+}
+
+func writeChunk(bw *bufio.Writer, p []byte) {
+	if len(p) != 0 {
+		fmt.Fprintf(bw, "%x\r\n", len(p))
+		bw.Write(p)
+		bw.WriteString("\r\n")
+	}
+}
+
+// readICAPStatus reads the status line of an ICAP response,
+// and the headers too when it's 100 Continue
+func readICAPStatus(br *bufio.Reader) (status int, e error) {
+	tp := textproto.NewReader(br)
+	var line string
+	line, e = tp.ReadLine()
+	fs := strings.Fields(line)
+	if e == nil && (len(fs) < 2 || !strings.HasPrefix(fs[0], "ICAP/")) {
+		e = fmt.Errorf("Malformed ICAP status line '%s'", line)
+	}
+	if e == nil {
+		status, e = strconv.Atoi(fs[1])
+	}
+	if e == nil && status == icapContinue {
+		_, e = tp.ReadMIMEHeader()
+	}
+	return
+}
+
+// read reads the headers of the response and the encapsulated
+// message. The body of the latter closes the connection when
+// closed
+func (r *icapResponse) read(br *bufio.Reader) (e error) {
+	var hd textproto.MIMEHeader
+	hd, e = textproto.NewReader(br).ReadMIMEHeader()
+	if e != nil || r.status != icapOK {
+		return
+	}
+	var names []string
+	var offsets []int
+	for _, s := range strings.Split(hd.Get("Encapsulated"), ",") {
+		kv := strings.SplitN(strings.TrimSpace(s), "=", 2)
+		var n int
+		if len(kv) == 2 {
+			n, e = strconv.Atoi(kv[1])
+		}
+		if e == nil && len(kv) == 2 &&
+			(len(offsets) == 0 || n >= offsets[len(offsets)-1]) {
+			names, offsets = append(names, kv[0]), append(offsets, n)
+		} else if e == nil {
+			e = fmt.Errorf("Malformed Encapsulated header '%s'",
+				hd.Get("Encapsulated"))
+		}
+		if e != nil {
+			return
+		}
+	}
+	last := len(names) - 1
+	var blocks []byte
+	if last >= 0 {
+		blocks = make([]byte, offsets[last])
+		_, e = io.ReadFull(br, blocks)
+	}
+	body := &connBody{conn: r.conn}
+	if last >= 0 && strings.HasSuffix(names[last], "-body") &&
+		names[last] != "null-body" {
+		body.Reader = httputil.NewChunkedReader(br)
+	}
+	for i := 0; e == nil && i < last; i++ {
+		block := bufio.NewReader(bytes.NewReader(
+			blocks[offsets[i]:offsets[i+1]]))
+		if names[i] == "req-hdr" {
+			r.req, e = h.ReadRequest(block)
+		} else if names[i] == "res-hdr" {
+			r.resp, e = h.ReadResponse(block, nil)
+		}
+	}
+	if e == nil && r.resp != nil {
+		r.resp.Body = body
+		r.resp.ContentLength = body.length(r.resp.Header)
+		r.resp.TransferEncoding = nil
+	} else if e == nil && r.req != nil {
+		r.req.Body = body
+		r.req.ContentLength = body.length(r.req.Header)
+	}
+	return
+}
+
+// connBody reads an encapsulated body, closing the connection
+// when closed. Reader is nil when there's no body
+type connBody struct {
+	io.Reader
+	conn net.Conn
+}
+
+func (b *connBody) Read(p []byte) (n int, e error) {
+	if b.Reader == nil {
+		e = io.EOF
+	} else {
+		n, e = b.Reader.Read(p)
+	}
+	return
+}
+
+// length returns the length of b, as declared by hd when
+// there's a body, or -1 when unknown
+func (b *connBody) length(hd h.Header) (n int64) {
+	if b.Reader != nil {
+		var e error
+		n, e = strconv.ParseInt(hd.Get("Content-Length"), 10, 64)
+		if e != nil || n < 0 {
+			n = -1
+		}
+	}
+	return
+}
+
+func (b *connBody) Close() (e error) {
+	e = b.conn.Close()
+	return
+}
+
+// modifyRequest replaces the parts of req by those of the
+// adapted request m
+func modifyRequest(req, m *h.Request) {
+	req.Method, req.Header, req.Body = m.Method, m.Header, m.Body
+	req.ContentLength, req.TransferEncoding = m.ContentLength, nil
+	if m.URL.IsAbs() {
+		req.URL = m.URL
+	} else {
+		u := *req.URL
+		u.Path, u.RawPath, u.RawQuery = m.URL.Path, m.URL.RawPath,
+			m.URL.RawQuery
+		req.URL = &u
+	}
+	if m.Host != "" {
+		req.Host, req.URL.Host = m.Host, m.Host
+	}
+	req.Header.Del("Host")
+}
+
+// requestHeader returns the header block of req, with its
+// target in origin form
+func requestHeader(req *h.Request) (block []byte) {
+	buf := new(bytes.Buffer)
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	fmt.Fprintf(buf, "%s %s HTTP/1.1\r\nHost: %s\r\n", req.Method,
+		req.URL.RequestURI(), host)
+	req.Header.Write(buf)
+	buf.WriteString("\r\n")
+	block = buf.Bytes()
+	return
+}
+
+func responseHeader(resp *h.Response) (block []byte) {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "HTTP/1.1 %d %s\r\n", resp.StatusCode,
+		h.StatusText(resp.StatusCode))
+	resp.Header.Write(buf)
+	buf.WriteString("\r\n")
+	block = buf.Bytes()
+	return
+}
+
+// recordedBody is a body whose read bytes are kept, for
+// replaying them when the server doesn't modify it. Beyond
+// limit, and after the preview, they are discarded
+type recordedBody struct {
+	io.ReadCloser
+	read bytes.Buffer
+	// length is the one of the body, -1 when unknown
+	length, limit int64
+	// preview is true while the preview isn't answered
+	preview bool
+	// lost means the recorded bytes were discarded
+	lost bool
+}
+
+func (b *recordedBody) Read(p []byte) (n int, e error) {
+	n, e = b.ReadCloser.Read(p)
+	if !b.lost {
+		b.read.Write(p[:n])
+		b.discard()
+	}
+	return
+}
+
+// replayable returns whether the complete body can be
+// replayed
+func (b *recordedBody) replayable() (ok bool) {
+	ok = b.length >= 0 && b.length <= b.limit
+	return
+}
+
+// previewed is called when the server answered the preview
+func (b *recordedBody) previewed() {
+	b.preview = false
+	b.discard()
+}
+
+// discard drops the recorded bytes when exceeding the limit
+// after the preview
+func (b *recordedBody) discard() {
+	if !b.preview && int64(b.read.Len()) > b.limit {
+		b.read, b.lost = bytes.Buffer{}, true
+	}
+}
+
+// replay returns a body with the read bytes followed by the
+// unread ones, or only the latter when the former were lost
+func (b *recordedBody) replay() (r io.ReadCloser, lost bool) {
+	lost, r = b.lost, b.ReadCloser
+	if !lost {
+		r = &readCloser{
+			Reader: io.MultiReader(bytes.NewReader(b.read.Bytes()),
+				b.ReadCloser),
+			Closer: b.ReadCloser,
+		}
+	}
+	return
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
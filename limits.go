@@ -0,0 +1,156 @@
+// Copyright © 2018-2019 Luis Ángel Méndez Gort
+
+// This file is part of Proxy.
+
+// Proxy is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General
+// Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your
+// option) any later version.
+
+// Proxy is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the
+// implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU Lesser General Public
+// License for more details.
+
+// You should have received a copy of the GNU Lesser General
+// Public License along with Proxy.  If not, see
+// <https://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"fmt"
+	"io"
+	h "net/http"
+)
+
+// BodyLimits bounds the sizes, in bytes, of the bodies of the
+// plain HTTP requests and responses, with 0 meaning no limit.
+// Clients are limited by the first rule that matches them, or
+// by Request and Response when none does.
+//
+// Requests with a larger body get 413 Request Entity Too
+// Large. Larger responses get 502 Bad Gateway when their
+// length is known in advance, or otherwise are cut off at the
+// limit, closing the client connection
+type BodyLimits struct {
+	Rules             []*LimitRule
+	Request, Response int64
+}
+
+// LimitRule has the body size limits for the matched clients
+type LimitRule struct {
+	Clients
+	Request, Response int64
+}
+
+// limits returns the limits for the client that made the
+// request, which are 0 when l is nil
+func (l *BodyLimits) limits(rqp *ReqParams) (req, resp int64) {
+	if l == nil {
+		return
+	}
+	req, resp = l.Request, l.Response
+	matched := false
+	for i := 0; rqp != nil && !matched && i != len(l.Rules); i++ {
+		matched = l.Rules[i].Match(rqp)
+		if matched {
+			req, resp = l.Rules[i].Request, l.Rules[i].Response
+		}
+	}
+	return
+}
+
+// MaxRequest returns the largest request limit, or 0 when
+// some client has none. A fasthttp.Server must accept bodies
+// of that size, with its MaxRequestBodySize
+func (l *BodyLimits) MaxRequest() (n int64) {
+	if l == nil {
+		return
+	}
+	n = l.Request
+	unlimited := n == 0
+	for _, r := range l.Rules {
+		unlimited = unlimited || r.Request == 0
+		if r.Request > n {
+			n = r.Request
+		}
+	}
+	if unlimited {
+		n = 0
+	}
+	return
+}
+
+// BodyLimitErr is the error of a body exceeding its limit
+type BodyLimitErr struct {
+	Limit int64
+	// Response is true for response bodies, and false for
+	// request ones
+	Response bool
+}
+
+func (e *BodyLimitErr) Error() (s string) {
+	body := "Request"
+	if e.Response {
+		body = "Response"
+	}
+	s = fmt.Sprintf("%s body exceeds the limit of %d bytes", body,
+		e.Limit)
+	return
+}
+
+// bodyTooLarge returns the error answered to the client when
+// a body exceeds limit
+func bodyTooLarge(limit int64, response bool) (e error) {
+	status := h.StatusRequestEntityTooLarge
+	if response {
+		status = h.StatusBadGateway
+	}
+	e = &HTTPErr{
+		Status: status,
+		Err:    &BodyLimitErr{Limit: limit, Response: response},
+	}
+	return
+}
+
+// limitedBody fails with err when reading more than n bytes
+type limitedBody struct {
+	io.ReadCloser
+	n   int64
+	err error
+}
+
+func (b *limitedBody) Read(p []byte) (n int, e error) {
+	// reading one more byte tells whether the body is larger
+	if int64(len(p)) > b.n+1 {
+		p = p[:b.n+1]
+	}
+	n, e = b.ReadCloser.Read(p)
+	if int64(n) > b.n {
+		n, e = int(b.n), b.err
+	}
+	b.n -= int64(n)
+	return
+}
+
+// limitedWriter fails with err when writing more than n bytes
+type limitedWriter struct {
+	io.Writer
+	n   int64
+	err error
+}
+
+func (w *limitedWriter) Write(p []byte) (n int, e error) {
+	if int64(len(p)) > w.n {
+		p, e = p[:w.n], w.err
+	}
+	n, we := w.Writer.Write(p)
+	w.n -= int64(n)
+	if we != nil {
+		e = we
+	}
+	return
+}
@@ -0,0 +1,183 @@
+// Copyright © 2018-2019 Luis Ángel Méndez Gort
+
+// This file is part of Proxy.
+
+// Proxy is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General
+// Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your
+// option) any later version.
+
+// Proxy is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the
+// implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU Lesser General Public
+// License for more details.
+
+// You should have received a copy of the GNU Lesser General
+// Public License along with Proxy.  If not, see
+// <https://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	h "net/http"
+
+	fh "github.com/valyala/fasthttp"
+)
+
+// Middleware has functions for inspecting and modifying the
+// requests forwarded by a Proxy, and their responses. Any of
+// them can be nil.
+//
+// The middlewares in Proxy.Middlewares run their request
+// functions in order, and their response functions in the
+// reverse one, like nested handlers. A request function
+// answering the request stops the chain, and only the
+// middlewares before it get the response.
+//
+// An error returned by a function stops the chain, and the
+// client gets the status of the HTTPErr in it, if any, or
+// otherwise 403 Forbidden when returned by a request
+// function and 502 Bad Gateway by a response one
+type Middleware struct {
+	// Connect is called with the CONNECT requests before
+	// dialing their destination, returning an error for
+	// rejecting them
+	Connect func(*ReqParams) error
+	// Request is called with the requests of the net/http
+	// front end, after the header policy was applied, and
+	// can modify them, including their URL. Returning a
+	// response answers the request without forwarding it
+	Request func(*h.Request) (*h.Response, error)
+	// Response is called with the responses of the net/http
+	// front end, before sending them to the client. The
+	// request is in their Request field
+	Response func(*h.Response) error
+	// FastRequest is Request for the fasthttp front end. ctx
+	// has the ReqParams, and answering the request is setting
+	// resp and returning true
+	FastRequest func(ctx context.Context, req *fh.Request,
+		resp *fh.Response) (bool, error)
+	// FastResponse is Response for the fasthttp front end. With
+	// Proxy.FastStream the body of resp is a stream, buffered
+	// when read
+	FastResponse func(ctx context.Context, req *fh.Request,
+		resp *fh.Response) error
+}
+
+// HTTPErr is an error answered to the client with Status
+type HTTPErr struct {
+	Status int
+	Err    error
+}
+
+func (e *HTTPErr) Error() (s string) {
+	if e.Err != nil {
+		s = e.Err.Error()
+	} else {
+		s = h.StatusText(e.Status)
+	}
+	return
+}
+
+func (e *HTTPErr) Unwrap() error {
+	return e.Err
+}
+
+// errStatus returns the status of the HTTPErr in e, or def
+// when there's none or it isn't valid
+func errStatus(e error, def int) (status int) {
+	status = def
+	var he *HTTPErr
+	if errors.As(e, &he) && validStatus(he.Status) {
+		status = he.Status
+	}
+	return
+}
+
+// validStatus returns whether status can be sent
+func validStatus(status int) (ok bool) {
+	ok = status >= 100 && status <= 999
+	return
+}
+
+type middlewares []*Middleware
+
+func (ms middlewares) connect(rqp *ReqParams) (e error) {
+	for i := 0; e == nil && i != len(ms); i++ {
+		if ms[i].Connect != nil {
+			e = ms[i].Connect(rqp)
+		}
+	}
+	return
+}
+
+// request runs the Request functions until one of them answers
+// or fails. n is the amount of middlewares whose Response
+// function must run. A response without status is 200 OK
+func (ms middlewares) request(req *h.Request) (resp *h.Response,
+	n int, e error) {
+	for ; e == nil && resp == nil && n != len(ms); n++ {
+		if ms[n].Request != nil {
+			resp, e = ms[n].Request(req)
+		}
+	}
+	if resp != nil {
+		// the answering middleware doesn't get its response
+		n--
+		if resp.Request == nil {
+			resp.Request = req
+		}
+		if resp.Body == nil {
+			resp.Body = h.NoBody
+		}
+		if resp.StatusCode == 0 {
+			resp.StatusCode = h.StatusOK
+		}
+		if !validStatus(resp.StatusCode) {
+			e = invalidStatus(resp.StatusCode)
+		}
+	}
+	return
+}
+
+// response runs the Response functions of the first n
+// middlewares in reverse order
+func (ms middlewares) response(resp *h.Response, n int) (e error) {
+	for i := n - 1; e == nil && i >= 0; i-- {
+		if ms[i].Response != nil {
+			e = ms[i].Response(resp)
+		}
+	}
+	if e == nil && !validStatus(resp.StatusCode) {
+		e = invalidStatus(resp.StatusCode)
+	}
+	return
+}
+
+func (ms middlewares) fastRequest(ctx context.Context,
+	req *fh.Request, resp *fh.Response) (answered bool, n int,
+	e error) {
+	for ; e == nil && !answered && n != len(ms); n++ {
+		if ms[n].FastRequest != nil {
+			answered, e = ms[n].FastRequest(ctx, req, resp)
+		}
+	}
+	if answered {
+		n--
+	}
+	return
+}
+
+func (ms middlewares) fastResponse(ctx context.Context,
+	req *fh.Request, resp *fh.Response, n int) (e error) {
+	for i := n - 1; e == nil && i >= 0; i-- {
+		if ms[i].FastResponse != nil {
+			e = ms[i].FastResponse(ctx, req, resp)
+		}
+	}
+	return
+}
@@ -0,0 +1,237 @@
+// Copyright © 2018-2019 Luis Ángel Méndez Gort
+
+// This file is part of Proxy.
+
+// Proxy is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General
+// Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your
+// option) any later version.
+
+// Proxy is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the
+// implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU Lesser General Public
+// License for more details.
+
+// You should have received a copy of the GNU Lesser General
+// Public License along with Proxy.  If not, see
+// <https://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	h "net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// MITM terminates the CONNECT tunnels to the destinations it
+// intercepts, presenting certificates signed by a local CA, and
+// proxies the decrypted HTTP/1.1 and HTTP/2 requests like plain
+// HTTP ones, connecting upstream with TLS again. Clients must
+// trust the CA
+type MITM struct {
+	// Hosts are the domains intercepted, including their
+	// subdomains. The empty string matches all of them
+	Hosts []string
+	// Bypass are domains never intercepted, like the ones of
+	// applications with pinned certificates
+	Bypass []string
+	// RootCAs verify the upstream servers. When nil the system
+	// pool is used
+	RootCAs *x509.CertPool
+
+	ca     tls.Certificate
+	caLeaf *x509.Certificate
+	mtx    sync.Mutex
+	certs  map[string]*tls.Certificate
+
+	transOnce sync.Once
+	trans     *h.Transport
+}
+
+// NewMITM creates a *MITM that signs certificates with the
+// CA certificate and key in the supplied PEM files
+func NewMITM(caCertFile, caKeyFile string) (m *MITM, e error) {
+	var ca tls.Certificate
+	ca, e = tls.LoadX509KeyPair(caCertFile, caKeyFile)
+	if e == nil {
+		m, e = newMITM(ca)
+	}
+	return
+}
+
+func newMITM(ca tls.Certificate) (m *MITM, e error) {
+	m = &MITM{ca: ca, certs: make(map[string]*tls.Certificate)}
+	m.caLeaf, e = x509.ParseCertificate(ca.Certificate[0])
+	return
+}
+
+// Intercepts returns whether the tunnels to host are
+// terminated
+func (m *MITM) Intercepts(host string) (ok bool) {
+	ok = matchDomains(m.Hosts, host) &&
+		!matchDomains(m.Bypass, host)
+	return
+}
+
+// matchDomains returns whether host is any of the domains or
+// a subdomain of them
+func matchDomains(domains []string, host string) (ok bool) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for i := 0; !ok && i != len(domains); i++ {
+		d := strings.ToLower(strings.TrimSuffix(domains[i], "."))
+		ok = d == "" || host == d || strings.HasSuffix(host, "."+d)
+	}
+	return
+}
+
+// certificate returns a certificate for host signed by the
+// CA, generating it when there isn't a valid one in the cache
+func (m *MITM) certificate(host string) (c *tls.Certificate,
+	e error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	c = m.certs[host]
+	if c == nil || time.Now().After(c.Leaf.NotAfter) {
+		c, e = m.newCertificate(host)
+		if e == nil {
+			m.certs[host] = c
+		}
+	}
+	return
+}
+
+func (m *MITM) newCertificate(host string) (c *tls.Certificate,
+	e error) {
+	var key *ecdsa.PrivateKey
+	key, e = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	var serial *big.Int
+	if e == nil {
+		serial, e = rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	}
+	var der []byte
+	if e == nil {
+		now := time.Now()
+		notAfter := now.AddDate(1, 0, 0)
+		if notAfter.After(m.caLeaf.NotAfter) {
+			notAfter = m.caLeaf.NotAfter
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: serial,
+			Subject:      pkix.Name{CommonName: host},
+			NotBefore:    now.Add(-time.Hour),
+			NotAfter:     notAfter,
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			tmpl.IPAddresses = []net.IP{ip}
+		} else {
+			tmpl.DNSNames = []string{host}
+		}
+		der, e = x509.CreateCertificate(rand.Reader, tmpl, m.caLeaf,
+			key.Public(), m.ca.PrivateKey.(crypto.Signer))
+	}
+	var leaf *x509.Certificate
+	if e == nil {
+		leaf, e = x509.ParseCertificate(der)
+	}
+	if e == nil {
+		c = &tls.Certificate{
+			Certificate: [][]byte{der, m.ca.Certificate[0]},
+			PrivateKey:  key,
+			Leaf:        leaf,
+		}
+	}
+	return
+}
+
+// transport returns a transport like base, but verifying the
+// upstream servers with RootCAs
+func (m *MITM) transport(base *h.Transport) (t *h.Transport) {
+	m.transOnce.Do(func() {
+		m.trans = base.Clone()
+		m.trans.TLSClientConfig = &tls.Config{RootCAs: m.RootCAs}
+	})
+	t = m.trans
+	return
+}
+
+// serveMITM terminates the TLS connection of the client, that
+// made the CONNECT request r, and proxies the requests sent
+// through it
+func (p *Proxy) serveMITM(client net.Conn, r *h.Request) {
+	host := r.URL.Host
+	hostname := r.URL.Hostname()
+	tc := tls.Server(client, &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (
+			*tls.Certificate, error) {
+			name := hello.ServerName
+			if name == "" {
+				name = hostname
+			}
+			return p.MITM.certificate(name)
+		},
+		NextProtos: []string{"h2", "http/1.1"},
+	})
+	connect := r.Context().Value(ReqParamsK).(*ReqParams)
+	trans := p.MITM.transport(p.trans)
+	hn := h.HandlerFunc(func(w h.ResponseWriter, r *h.Request) {
+		r.URL.Scheme, r.URL.Host = "https", host
+		i := &ReqParams{
+			Method: r.Method,
+			IP:     connect.IP,
+			URL:    host,
+			User:   connect.User,
+		}
+		c := context.WithValue(r.Context(), ReqParamsK, i)
+		p.handleHTTPWith(w, r.WithContext(c), trans, nil)
+	})
+	e := tc.Handshake()
+	if e == nil {
+		if tc.ConnectionState().NegotiatedProtocol == "h2" {
+			new(http2.Server).ServeConn(tc,
+				&http2.ServeConnOpts{Handler: hn})
+			tc.Close()
+		} else {
+			srv := &h.Server{Handler: hn, IdleTimeout: 90 * time.Second}
+			srv.Serve(&oneConnListener{c: tc})
+		}
+	} else {
+		client.Close()
+	}
+}
+
+// oneConnListener returns a connection the first time Accept
+// is called, and io.EOF afterwards
+type oneConnListener struct {
+	c net.Conn
+}
+
+func (l *oneConnListener) Accept() (c net.Conn, e error) {
+	c, l.c = l.c, nil
+	if c == nil {
+		e = io.EOF
+	}
+	return
+}
+
+func (l *oneConnListener) Close() (e error) { return }
+
+func (l *oneConnListener) Addr() (a net.Addr) { return }
@@ -0,0 +1,257 @@
+// Copyright © 2018-2019 Luis Ángel Méndez Gort
+
+// This file is part of Proxy.
+
+// Proxy is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General
+// Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your
+// option) any later version.
+
+// Proxy is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the
+// implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU Lesser General Public
+// License for more details.
+
+// You should have received a copy of the GNU Lesser General
+// Public License along with Proxy.  If not, see
+// <https://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4"
+)
+
+// NTLM message flags, from [MS-NLMP] 2.2.2.5
+const (
+	ntlmNegotiateUnicode     = 0x00000001
+	ntlmNegotiateOEM         = 0x00000002
+	ntlmRequestTarget        = 0x00000004
+	ntlmNegotiateNTLM        = 0x00000200
+	ntlmNegotiateAlwaysSign  = 0x00008000
+	ntlmNegotiateExtendedSec = 0x00080000
+	ntlmNegotiateTargetInfo  = 0x00800000
+	ntlmNegotiateFlags       = ntlmNegotiateUnicode |
+		ntlmNegotiateOEM | ntlmRequestTarget | ntlmNegotiateNTLM |
+		ntlmNegotiateAlwaysSign | ntlmNegotiateExtendedSec
+)
+
+const (
+	ntlmSignature              = "NTLMSSP\x00"
+	ntlmAvTimestamp            = 7
+	ntlmChallengeMinLen        = 32
+	ntlmAuthenticateHeaderSize = 64
+)
+
+// ntlmSession authenticates with NTLMv2 using a user name,
+// that can be qualified with its domain as DOMAIN\user, and a
+// password
+type ntlmSession struct {
+	domain   string
+	user     string
+	password string
+	round    int
+}
+
+func newNTLMSession(user, password string) (s *ntlmSession) {
+	s = &ntlmSession{user: user, password: password}
+	if i := strings.IndexAny(user, `\/`); i != -1 {
+		s.domain, s.user = user[:i], user[i+1:]
+	}
+	return
+}
+
+func (s *ntlmSession) Scheme() (r string) {
+	r = "NTLM"
+	return
+}
+
+func (s *ntlmSession) Next(challenge string) (auth string,
+	e error) {
+	var msg []byte
+	if s.round == 0 {
+		msg = ntlmNegotiate()
+	} else if s.round == 1 {
+		var ch []byte
+		ch, e = base64.StdEncoding.DecodeString(challenge)
+		var serverChallenge, targetInfo []byte
+		if e == nil {
+			serverChallenge, targetInfo, e = parseNTLMChallenge(ch)
+		}
+		if e == nil {
+			msg, e = s.authenticate(serverChallenge, targetInfo)
+		}
+	}
+	// after the AUTHENTICATE_MESSAGE the handshake ends
+	s.round++
+	if e == nil && msg != nil {
+		auth = s.Scheme() + " " + base64.StdEncoding.EncodeToString(msg)
+	}
+	return
+}
+
+// ntlmNegotiate returns the NEGOTIATE_MESSAGE, without domain
+// and workstation
+func ntlmNegotiate() (msg []byte) {
+	msg = make([]byte, 32)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 1)
+	binary.LittleEndian.PutUint32(msg[12:], ntlmNegotiateFlags)
+	return
+}
+
+// parseNTLMChallenge returns the server challenge and target
+// information in a CHALLENGE_MESSAGE
+func parseNTLMChallenge(msg []byte) (serverChallenge,
+	targetInfo []byte, e error) {
+	if len(msg) < ntlmChallengeMinLen ||
+		string(msg[:8]) != ntlmSignature ||
+		binary.LittleEndian.Uint32(msg[8:]) != 2 {
+		e = &NTLMErr{Reason: "malformed challenge message"}
+	}
+	if e == nil {
+		serverChallenge = msg[24:32]
+		flags := binary.LittleEndian.Uint32(msg[20:])
+		if flags&ntlmNegotiateTargetInfo != 0 && len(msg) >= 48 {
+			n := int(binary.LittleEndian.Uint16(msg[40:]))
+			off := int(binary.LittleEndian.Uint32(msg[44:]))
+			if off+n <= len(msg) {
+				targetInfo = msg[off : off+n]
+			} else {
+				e = &NTLMErr{Reason: "malformed target information"}
+			}
+		}
+	}
+	return
+}
+
+// authenticate returns the AUTHENTICATE_MESSAGE with the
+// NTLMv2 response to the server challenge
+func (s *ntlmSession) authenticate(serverChallenge,
+	targetInfo []byte) (msg []byte, e error) {
+	clientChallenge := make([]byte, 8)
+	_, e = rand.Read(clientChallenge)
+	if e == nil {
+		hash := ntlmV2Hash(s.user, s.password, s.domain)
+		timestamp, fromServer := ntlmTimestamp(targetInfo)
+		nt := ntlmV2Response(hash, serverChallenge, clientChallenge,
+			timestamp, targetInfo)
+		// [MS-NLMP] 3.1.5.1.2: with the server timestamp the
+		// LMv2 response is zeros
+		lm := make([]byte, 24)
+		if !fromServer {
+			lm = append(hmacMD5(hash, serverChallenge, clientChallenge),
+				clientChallenge...)
+		}
+		fields := [][]byte{
+			lm, nt, utf16LE(s.domain), utf16LE(s.user), nil,
+		}
+		msg = make([]byte, ntlmAuthenticateHeaderSize)
+		copy(msg, ntlmSignature)
+		binary.LittleEndian.PutUint32(msg[8:], 3)
+		// security buffers for the fields, and the empty session key
+		off := len(msg)
+		for i, f := range append(fields, nil) {
+			putNTLMBuffer(msg[12+8*i:], len(f), off)
+			off += len(f)
+			msg = append(msg, f...)
+		}
+		binary.LittleEndian.PutUint32(msg[60:], ntlmNegotiateFlags)
+	}
+	return
+}
+
+func putNTLMBuffer(b []byte, n, off int) {
+	binary.LittleEndian.PutUint16(b, uint16(n))
+	binary.LittleEndian.PutUint16(b[2:], uint16(n))
+	binary.LittleEndian.PutUint32(b[4:], uint32(off))
+}
+
+// ntlmV2Hash is NTOWFv2 in [MS-NLMP] 3.3.2
+func ntlmV2Hash(user, password, domain string) (hash []byte) {
+	h := md4.New()
+	h.Write(utf16LE(password))
+	hash = hmacMD5(h.Sum(nil), utf16LE(strings.ToUpper(user)+domain))
+	return
+}
+
+// ntlmV2Response is the NTChallengeResponse computed in
+// [MS-NLMP] 3.3.2, the NTProofStr followed by the client blob
+func ntlmV2Response(hash, serverChallenge, clientChallenge,
+	timestamp, targetInfo []byte) (r []byte) {
+	blob := new(bytes.Buffer)
+	blob.Write([]byte{1, 1, 0, 0, 0, 0, 0, 0})
+	blob.Write(timestamp)
+	blob.Write(clientChallenge)
+	blob.Write([]byte{0, 0, 0, 0})
+	blob.Write(targetInfo)
+	blob.Write([]byte{0, 0, 0, 0})
+	r = append(hmacMD5(hash, serverChallenge, blob.Bytes()),
+		blob.Bytes()...)
+	return
+}
+
+// ntlmTimestamp returns the timestamp in the target
+// information, or the current time, as a FILETIME. fromServer
+// tells which of them it is
+func ntlmTimestamp(targetInfo []byte) (ts []byte, fromServer bool) {
+	for len(targetInfo) >= 4 && ts == nil {
+		id := binary.LittleEndian.Uint16(targetInfo)
+		n := int(binary.LittleEndian.Uint16(targetInfo[2:]))
+		if id == ntlmAvTimestamp && n == 8 && len(targetInfo) >= 12 {
+			ts = targetInfo[4:12]
+		}
+		if 4+n <= len(targetInfo) {
+			targetInfo = targetInfo[4+n:]
+		} else {
+			targetInfo = nil
+		}
+	}
+	fromServer = ts != nil
+	if ts == nil {
+		// 100 nanosecond intervals since January 1, 1601
+		ft := uint64(time.Now().UnixNano()/100) + 116444736000000000
+		ts = make([]byte, 8)
+		binary.LittleEndian.PutUint64(ts, ft)
+	}
+	return
+}
+
+func hmacMD5(key []byte, data ...[]byte) (sum []byte) {
+	m := hmac.New(md5.New, key)
+	for _, d := range data {
+		m.Write(d)
+	}
+	sum = m.Sum(nil)
+	return
+}
+
+func utf16LE(s string) (bs []byte) {
+	for _, u := range utf16.Encode([]rune(s)) {
+		bs = append(bs, byte(u), byte(u>>8))
+	}
+	return
+}
+
+// NTLMErr is returned when the NTLM handshake with a parent
+// proxy cannot be completed
+type NTLMErr struct {
+	Reason string
+}
+
+func (e *NTLMErr) Error() (s string) {
+	s = "NTLM authentication: " + e.Reason
+	return
+}
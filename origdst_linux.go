@@ -0,0 +1,88 @@
+// Copyright © 2018-2019 Luis Ángel Méndez Gort
+
+// This file is part of Proxy.
+
+// Proxy is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General
+// Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your
+// option) any later version.
+
+// Proxy is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the
+// implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU Lesser General Public
+// License for more details.
+
+// You should have received a copy of the GNU Lesser General
+// Public License along with Proxy.  If not, see
+// <https://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST in linux/netfilter_ipv4.h,
+// and IP6T_SO_ORIGINAL_DST in linux/netfilter_ipv6/ip6_tables.h
+const soOriginalDst = 80
+
+// originalDst returns the destination address a connection
+// had before being redirected by netfilter
+func originalDst(c net.Conn) (addr string, e error) {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		e = noOriginalDst()
+	}
+	var rc syscall.RawConn
+	if e == nil {
+		rc, e = tc.SyscallConn()
+	}
+	if e == nil {
+		level := syscall.IPPROTO_IP
+		if la, ok := c.LocalAddr().(*net.TCPAddr); ok &&
+			la.IP.To4() == nil {
+			level = syscall.IPPROTO_IPV6
+		}
+		var ce error
+		e = rc.Control(func(fd uintptr) {
+			addr, ce = getOriginalDst(fd, level)
+		})
+		if e == nil {
+			e = ce
+		}
+	}
+	return
+}
+
+func getOriginalDst(fd uintptr, level int) (addr string,
+	e error) {
+	// enough for a sockaddr_in6
+	var sa [28]byte
+	n := uint32(len(sa))
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd,
+		uintptr(level), soOriginalDst,
+		uintptr(unsafe.Pointer(&sa[0])), uintptr(unsafe.Pointer(&n)),
+		0)
+	if errno != 0 {
+		e = errno
+	}
+	if e == nil {
+		// the port is in network byte order in both sockaddr_in
+		// and sockaddr_in6
+		port := int(binary.BigEndian.Uint16(sa[2:4]))
+		var ip net.IP
+		if level == syscall.IPPROTO_IP {
+			ip = net.IP(sa[4:8])
+		} else {
+			ip = net.IP(sa[8:24])
+		}
+		addr = net.JoinHostPort(ip.String(), strconv.Itoa(port))
+	}
+	return
+}
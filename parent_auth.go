@@ -0,0 +1,319 @@
+// Copyright © 2018-2019 Luis Ángel Méndez Gort
+
+// This file is part of Proxy.
+
+// Proxy is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General
+// Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your
+// option) any later version.
+
+// Proxy is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the
+// implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU Lesser General Public
+// License for more details.
+
+// You should have received a copy of the GNU Lesser General
+// Public License along with Proxy.  If not, see
+// <https://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// AuthSession authenticates with a parent proxy using a
+// scheme that can need several requests, like NTLM, Negotiate
+// or Digest
+type AuthSession interface {
+	// Scheme is the name of the authentication scheme
+	Scheme() string
+	// Next returns the Proxy-Authorization value answering the
+	// challenge sent by the proxy, that is the text following
+	// the scheme name in Proxy-Authenticate. An empty value
+	// ends the handshake unsuccessfully
+	Next(challenge string) (string, error)
+}
+
+// ParentCredentials, when not nil, supplies the user and
+// password for the parent proxies whose URL doesn't have them.
+// NTLM users can be qualified with their domain as DOMAIN\user
+var ParentCredentials func(parent *url.URL) (user,
+	password string, e error)
+
+// NegotiateProvider, when not nil, creates the sessions for
+// authenticating with the parent proxies offering the
+// Negotiate scheme (SPNEGO), which is preferred over the rest
+var NegotiateProvider func(parent *url.URL) (AuthSession, error)
+
+// ProxyAuthErr is returned when a parent proxy still answers
+// 407 Proxy Authentication Required once the handshake ends,
+// because its credentials were rejected or none of its
+// schemes is supported
+type ProxyAuthErr struct {
+	// Challenges are the Proxy-Authenticate headers of the
+	// last response
+	Challenges []string
+}
+
+func (e *ProxyAuthErr) Error() (s string) {
+	s = fmt.Sprintf("Parent proxy authentication failed, "+
+		"challenges: %s", strings.Join(e.Challenges, "; "))
+	return
+}
+
+// authChallenge is a challenge in a Proxy-Authenticate header
+type authChallenge struct {
+	scheme string
+	// data is the token68 or the parameters after the scheme
+	data string
+}
+
+// parseChallenges returns the challenges in the
+// Proxy-Authenticate headers in hd. A header can have several
+// of them, separated by commas like their parameters
+func parseChallenges(hd http.Header) (cs []*authChallenge) {
+	for _, v := range hd["Proxy-Authenticate"] {
+		for _, item := range splitQuoted(v, ',') {
+			item = strings.TrimSpace(item)
+			name, rest := item, ""
+			if i := strings.IndexAny(item, " \t"); i != -1 {
+				name, rest = item[:i], strings.TrimSpace(item[i:])
+			}
+			// auth-params have a = after the name, unlike schemes
+			isScheme := !strings.Contains(name, "=") &&
+				!strings.HasPrefix(rest, "=")
+			if item != "" && isScheme {
+				cs = append(cs, &authChallenge{scheme: name, data: rest})
+			} else if item != "" && len(cs) != 0 {
+				c := cs[len(cs)-1]
+				if c.data != "" {
+					c.data += ", "
+				}
+				c.data += item
+			}
+		}
+	}
+	return
+}
+
+// offers returns whether hd has a challenge for scheme
+func offers(hd http.Header, scheme string) (ok bool) {
+	cs := parseChallenges(hd)
+	for i := 0; !ok && i != len(cs); i++ {
+		ok = strings.EqualFold(cs[i].scheme, scheme)
+	}
+	return
+}
+
+// challenge returns the data of the challenge for scheme in
+// hd. Among several Digest challenges the one with the
+// strongest supported algorithm is chosen
+func challenge(hd http.Header, scheme string) (data string) {
+	rank := -1
+	for _, c := range parseChallenges(hd) {
+		if strings.EqualFold(c.scheme, scheme) {
+			r := 0
+			if strings.EqualFold(scheme, "Digest") {
+				_, r = digestHash(parseParams(c.data)["algorithm"])
+			}
+			if r > rank {
+				data, rank = c.data, r
+			}
+		}
+	}
+	return
+}
+
+// parseParams returns the auth-params in data with lower case
+// names and unquoted values
+func parseParams(data string) (ps map[string]string) {
+	ps = make(map[string]string)
+	for _, item := range splitQuoted(data, ',') {
+		if i := strings.IndexByte(item, '='); i != -1 {
+			k := strings.ToLower(strings.TrimSpace(item[:i]))
+			v := strings.TrimSpace(item[i+1:])
+			if len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"' {
+				v = unquote(v[1 : len(v)-1])
+			}
+			ps[k] = v
+		}
+	}
+	return
+}
+
+// splitQuoted splits s by sep, except inside quoted strings
+func splitQuoted(s string, sep byte) (ss []string) {
+	quoted, escaped, start := false, false, 0
+	for i := 0; i != len(s); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && s[i] == '\\':
+			escaped = true
+		case s[i] == '"':
+			quoted = !quoted
+		case !quoted && s[i] == sep:
+			ss = append(ss, s[start:i])
+			start = i + 1
+		}
+	}
+	ss = append(ss, s[start:])
+	return
+}
+
+func unquote(s string) (r string) {
+	var b strings.Builder
+	for i := 0; i != len(s); i++ {
+		if s[i] == '\\' && i+1 != len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	r = b.String()
+	return
+}
+
+func quote(s string) (r string) {
+	r = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) +
+		`"`
+	return
+}
+
+func basicAuth(user, password string) (auth string) {
+	auth = "Basic " +
+		base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+	return
+}
+
+// basicSession sends the credentials once, unless they were
+// already sent
+type basicSession struct {
+	user     string
+	password string
+	sent     bool
+}
+
+func (s *basicSession) Scheme() (r string) {
+	r = "Basic"
+	return
+}
+
+func (s *basicSession) Next(challenge string) (auth string,
+	e error) {
+	if !s.sent {
+		auth, s.sent = basicAuth(s.user, s.password), true
+	}
+	return
+}
+
+// digestSession answers Digest challenges as described in
+// RFC 7616, with qop=auth or without qop, for requests with
+// method and uri
+type digestSession struct {
+	user     string
+	password string
+	method   string
+	uri      string
+	nonce    string
+	nc       int
+}
+
+func (s *digestSession) Scheme() (r string) {
+	r = "Digest"
+	return
+}
+
+func (s *digestSession) Next(challenge string) (auth string,
+	e error) {
+	ps := parseParams(challenge)
+	newHash, _ := digestHash(ps["algorithm"])
+	qop := ""
+	for _, q := range strings.Split(ps["qop"], ",") {
+		if strings.TrimSpace(q) == "auth" {
+			qop = "auth"
+		}
+	}
+	// a nonce answered before is only answered again when the
+	// proxy considers it stale, otherwise the credentials were
+	// rejected
+	retry := s.nonce == "" || strings.EqualFold(ps["stale"], "true")
+	if retry && newHash != nil && (qop != "" || ps["qop"] == "") {
+		if ps["nonce"] != s.nonce {
+			s.nonce, s.nc = ps["nonce"], 0
+		}
+		s.nc++
+		auth, e = s.authorization(ps, newHash, qop)
+	}
+	return
+}
+
+func (s *digestSession) authorization(ps map[string]string,
+	newHash func() hash.Hash, qop string) (auth string, e error) {
+	h := func(vs ...string) string {
+		d := newHash()
+		d.Write([]byte(strings.Join(vs, ":")))
+		return hex.EncodeToString(d.Sum(nil))
+	}
+	cb := make([]byte, 16)
+	_, e = rand.Read(cb)
+	if e == nil {
+		cnonce, nc := hex.EncodeToString(cb), fmt.Sprintf("%08x", s.nc)
+		ha1 := h(s.user, ps["realm"], s.password)
+		if strings.HasSuffix(strings.ToLower(ps["algorithm"]), "-sess") {
+			ha1 = h(ha1, s.nonce, cnonce)
+		}
+		ha2 := h(s.method, s.uri)
+		var response string
+		if qop == "" {
+			response = h(ha1, s.nonce, ha2)
+		} else {
+			response = h(ha1, s.nonce, nc, cnonce, qop, ha2)
+		}
+		fields := []string{
+			"username=" + quote(s.user),
+			"realm=" + quote(ps["realm"]),
+			"nonce=" + quote(s.nonce),
+			"uri=" + quote(s.uri),
+			"response=" + quote(response),
+		}
+		if a := ps["algorithm"]; a != "" {
+			fields = append(fields, "algorithm="+a)
+		}
+		if qop != "" {
+			fields = append(fields, "qop="+qop, "nc="+nc,
+				"cnonce="+quote(cnonce))
+		}
+		if o, ok := ps["opaque"]; ok {
+			fields = append(fields, "opaque="+quote(o))
+		}
+		auth = "Digest " + strings.Join(fields, ", ")
+	}
+	return
+}
+
+// digestHash returns the hash function for a Digest
+// algorithm, nil if not supported, and a rank preferring the
+// strongest
+func digestHash(algorithm string) (newHash func() hash.Hash,
+	rank int) {
+	switch strings.ToUpper(strings.TrimSuffix(
+		strings.ToLower(algorithm), "-sess")) {
+	case "", "MD5":
+		newHash, rank = md5.New, 1
+	case "SHA-256":
+		newHash, rank = sha256.New, 2
+	}
+	return
+}
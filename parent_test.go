@@ -0,0 +1,494 @@
+// Copyright © 2018-2019 Luis Ángel Méndez Gort
+
+// This file is part of Proxy.
+
+// Proxy is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General
+// Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your
+// option) any later version.
+
+// Proxy is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the
+// implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU Lesser General Public
+// License for more details.
+
+// You should have received a copy of the GNU Lesser General
+// Public License along with Proxy.  If not, see
+// <https://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	h "net/http"
+	ht "net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParentNTLM(t *testing.T) {
+	serverChallenge := []byte("01234567")
+	var user string
+	parent := fakeParent(t, func(r *h.Request) (status int,
+		hd h.Header) {
+		auth := r.Header.Get("Proxy-Authorization")
+		status, hd = h.StatusProxyAuthRequired, make(h.Header)
+		if auth == "" {
+			hd["Proxy-Authenticate"] = []string{"Basic realm=\"x\"", "NTLM"}
+		} else if msg := ntlmMessage(t, auth); msg[8] == 1 {
+			hd.Set("Proxy-Authenticate", "NTLM "+
+				base64.StdEncoding.EncodeToString(
+					ntlmChallenge(serverChallenge)))
+		} else if msg[8] == 3 {
+			domain, usr, lm, nt := parseNTLMAuthenticate(t, msg)
+			// the challenge has a timestamp
+			require.Equal(t, make([]byte, 24), lm)
+			hash := ntlmV2Hash(usr, "secret", domain)
+			proof := hmacMD5(hash, serverChallenge, nt[16:])
+			if string(proof) == string(nt[:16]) {
+				user, status = domain+`\`+usr, h.StatusOK
+			}
+		}
+		return
+	})
+	ParentCredentials = func(u *url.URL) (string, string, error) {
+		return `CORP\pepe`, "secret", nil
+	}
+	defer func() { ParentCredentials = nil }()
+	dialEcho(t, parent)
+	require.Equal(t, `CORP\pepe`, user)
+}
+
+func TestParentNegotiate(t *testing.T) {
+	parent := fakeParent(t, func(r *h.Request) (status int,
+		hd h.Header) {
+		status, hd = h.StatusProxyAuthRequired, make(h.Header)
+		switch r.Header.Get("Proxy-Authorization") {
+		case "":
+			hd["Proxy-Authenticate"] = []string{"NTLM", "Negotiate"}
+		case "Negotiate first":
+			hd.Set("Proxy-Authenticate", "Negotiate bla")
+		case "Negotiate bla-answer":
+			status = h.StatusOK
+		}
+		return
+	})
+	NegotiateProvider = func(u *url.URL) (AuthSession, error) {
+		return new(fakeNegotiate), nil
+	}
+	defer func() { NegotiateProvider = nil }()
+	dialEcho(t, parent)
+}
+
+type fakeNegotiate struct{}
+
+func (n *fakeNegotiate) Scheme() string { return "Negotiate" }
+
+func (n *fakeNegotiate) Next(ch string) (auth string, e error) {
+	auth = "Negotiate first"
+	if ch != "" {
+		auth = "Negotiate " + ch + "-answer"
+	}
+	return
+}
+
+// fakeParent serves a parent proxy, answering the requests
+// through a connection with handle, and echoing what's
+// received after answering 200
+func fakeParent(t *testing.T, handle func(*h.Request) (int,
+	h.Header)) (parent *url.URL) {
+	l, e := net.Listen(tcp, "127.0.0.1:0")
+	require.NoError(t, e)
+	go func() {
+		defer l.Close()
+		c, e := l.Accept()
+		if e != nil {
+			return
+		}
+		defer c.Close()
+		br := bufio.NewReader(c)
+		for status := 0; status != h.StatusOK && e == nil; {
+			var r *h.Request
+			r, e = h.ReadRequest(br)
+			if e == nil {
+				var hd h.Header
+				status, hd = handle(r)
+				resp := &h.Response{
+					StatusCode:    status,
+					ProtoMajor:    1,
+					ProtoMinor:    1,
+					Header:        hd,
+					ContentLength: 0,
+				}
+				if status != h.StatusOK {
+					resp.Body = h.NoBody
+				}
+				e = resp.Write(c)
+			}
+		}
+		if e == nil {
+			io.Copy(c, br)
+		}
+	}()
+	registerDialers()
+	parent = &url.URL{Scheme: "http", Host: l.Addr().String()}
+	return
+}
+
+// dialEcho dials through parent, checking that the tunnel
+// echoes
+func dialEcho(t *testing.T, parent *url.URL) {
+	c, e := DialProxy(tcp, "example.com:443", parent,
+		&IfaceDialer{Timeout: time.Second})
+	require.NoError(t, e)
+	requireEcho(t, c)
+}
+
+func requireEcho(t *testing.T, c net.Conn) {
+	defer c.Close()
+	_, e := c.Write([]byte("bla"))
+	require.NoError(t, e)
+	bs := make([]byte, 3)
+	_, e = io.ReadFull(c, bs)
+	require.NoError(t, e)
+	require.Equal(t, "bla", string(bs))
+}
+
+func ntlmMessage(t *testing.T, auth string) (msg []byte) {
+	require.True(t, strings.HasPrefix(auth, "NTLM "))
+	msg, e := base64.StdEncoding.DecodeString(auth[5:])
+	require.NoError(t, e)
+	require.Equal(t, ntlmSignature, string(msg[:8]))
+	return
+}
+
+// ntlmChallenge returns a CHALLENGE_MESSAGE with target
+// information including a timestamp
+func ntlmChallenge(serverChallenge []byte) (msg []byte) {
+	info := []byte{ntlmAvTimestamp, 0, 8, 0, 1, 2, 3, 4, 5, 6, 7, 8,
+		0, 0, 0, 0}
+	msg = make([]byte, 48)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 2)
+	binary.LittleEndian.PutUint32(msg[20:],
+		ntlmNegotiateFlags|ntlmNegotiateTargetInfo)
+	copy(msg[24:], serverChallenge)
+	putNTLMBuffer(msg[40:], len(info), len(msg))
+	msg = append(msg, info...)
+	return
+}
+
+func parseNTLMAuthenticate(t *testing.T, msg []byte) (domain,
+	user string, lm, nt []byte) {
+	field := func(off int) []byte {
+		n := int(binary.LittleEndian.Uint16(msg[off:]))
+		start := int(binary.LittleEndian.Uint32(msg[off+4:]))
+		require.True(t, start+n <= len(msg))
+		return msg[start : start+n]
+	}
+	fromUTF16 := func(bs []byte) (s string) {
+		for i := 0; i+1 < len(bs); i += 2 {
+			s += string(rune(binary.LittleEndian.Uint16(bs[i:])))
+		}
+		return
+	}
+	lm, nt, domain, user = field(12), field(20), fromUTF16(field(28)),
+		fromUTF16(field(36))
+	require.True(t, len(nt) > 16)
+	return
+}
+
+func TestParentAuthUnsupported(t *testing.T) {
+	parent := fakeParent(t, func(r *h.Request) (int, h.Header) {
+		hd := make(h.Header)
+		hd.Set("Proxy-Authenticate", "Bearer realm=\"x\"")
+		return h.StatusProxyAuthRequired, hd
+	})
+	_, e := DialProxy(tcp, "example.com:443", parent,
+		&IfaceDialer{Timeout: time.Second})
+	var ae *ProxyAuthErr
+	require.True(t, errors.As(e, &ae), fmt.Sprint(e))
+	require.Equal(t, []string{"Bearer realm=\"x\""}, ae.Challenges)
+}
+
+func TestParentDigest(t *testing.T) {
+	nonces := []string{"n0", "n1"}
+	rounds := 0
+	parent := fakeParent(t, func(r *h.Request) (status int,
+		hd h.Header) {
+		status, hd = h.StatusProxyAuthRequired, make(h.Header)
+		auth := r.Header.Get("Proxy-Authorization")
+		ps := parseParams(strings.TrimPrefix(auth, "Digest "))
+		stale := false
+		// Basic credentials from the URL are sent first
+		if strings.HasPrefix(auth, "Digest ") {
+			rounds++
+			require.Equal(t, "example.com:443", ps["uri"])
+			require.Equal(t, "SHA-256", ps["algorithm"])
+			ha1 := sha256Hex("pepe:proxy:secret")
+			ha2 := sha256Hex("CONNECT:" + ps["uri"])
+			expected := sha256Hex(ha1 + ":" + ps["nonce"] + ":" +
+				ps["nc"] + ":" + ps["cnonce"] + ":auth:" + ha2)
+			ok := expected == ps["response"] && ps["opaque"] == "op"
+			// the first nonce is stale
+			stale = ok && ps["nonce"] == nonces[0]
+			if ok && ps["nonce"] == nonces[1] {
+				status = h.StatusOK
+			}
+		}
+		nonce := nonces[0]
+		if stale {
+			nonce = nonces[1]
+		}
+		hd["Proxy-Authenticate"] = []string{
+			`Basic realm="proxy", Digest realm="proxy", qop="auth", ` +
+				`nonce="` + nonce + `", opaque="op", algorithm=MD5`,
+			`Digest realm="proxy", qop="auth,auth-int", nonce="` +
+				nonce + `", opaque="op", algorithm=SHA-256, ` +
+				fmt.Sprintf("stale=%t", stale),
+		}
+		return
+	})
+	parent.User = url.UserPassword("pepe", "secret")
+	dialEcho(t, parent)
+	require.Equal(t, 2, rounds)
+}
+
+func TestParentBasic(t *testing.T) {
+	handle := func(r *h.Request) (status int, hd h.Header) {
+		status, hd = h.StatusProxyAuthRequired, make(h.Header)
+		if r.Header.Get("Proxy-Authorization") ==
+			basicAuth("pepe", "secret") {
+			status = h.StatusOK
+		}
+		hd.Set("Proxy-Authenticate", `Basic realm="proxy"`)
+		return
+	}
+	ParentCredentials = func(u *url.URL) (string, string, error) {
+		return "pepe", "secret", nil
+	}
+	defer func() { ParentCredentials = nil }()
+	dialEcho(t, fakeParent(t, handle))
+
+	// wrong credentials in the URL are sent only once
+	parent := fakeParent(t, handle)
+	parent.User = url.UserPassword("pepe", "bla")
+	_, e := DialProxy(tcp, "example.com:443", parent,
+		&IfaceDialer{Timeout: time.Second})
+	var ae *ProxyAuthErr
+	require.True(t, errors.As(e, &ae), fmt.Sprint(e))
+	require.Equal(t, []string{`Basic realm="proxy"`}, ae.Challenges)
+
+	// CONNECT only tunnels TCP
+	_, e = DialProxy("udp", "example.com:443", parent,
+		&IfaceDialer{Timeout: time.Second})
+	require.EqualError(t, e, "Network 'udp' not supported by HTTP "+
+		"proxies")
+}
+
+func TestParseChallenges(t *testing.T) {
+	ts := []struct {
+		values []string
+		cs     []authChallenge
+	}{
+		{
+			[]string{"NTLM", "Negotiate TlRMTVNTUAACAAAA=="},
+			[]authChallenge{{"NTLM", ""},
+				{"Negotiate", "TlRMTVNTUAACAAAA=="}},
+		},
+		{
+			[]string{`Basic realm="a, b", Digest realm = "x",` +
+				`nonce="y\"z", qop="auth,auth-int"`},
+			[]authChallenge{{"Basic", `realm="a, b"`},
+				{"Digest", `realm = "x", nonce="y\"z", qop="auth,auth-int"`}},
+		},
+		{
+			[]string{", Bearer ,"},
+			[]authChallenge{{"Bearer", ""}},
+		},
+	}
+	for i, j := range ts {
+		hd := h.Header{"Proxy-Authenticate": j.values}
+		cs := parseChallenges(hd)
+		require.Equal(t, len(j.cs), len(cs), "At %d", i)
+		for k, c := range cs {
+			require.Equal(t, j.cs[k], *c, "At %d", i)
+		}
+	}
+	ps := parseParams(`realm = "x", nonce="y\"z", qop="auth,auth-int"`)
+	require.Equal(t, map[string]string{
+		"realm": "x", "nonce": `y"z`, "qop": "auth,auth-int",
+	}, ps)
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestChainDialer(t *testing.T) {
+	dialed := make(chan string, 1)
+	first := ht.NewServer(NewProxy(func(ctx context.Context,
+		n, a string) (net.Conn, error) {
+		dialed <- a
+		return new(net.Dialer).DialContext(ctx, n, a)
+	}))
+	defer first.Close()
+	firstURL, e := url.Parse(first.URL)
+	require.NoError(t, e)
+	chain := func(last *url.URL, timeout time.Duration) *ChainDialer {
+		return &ChainDialer{
+			Hops: []Hop{
+				{URL: firstURL},
+				{URL: last, Timeout: timeout},
+			},
+			Direct: &IfaceDialer{Timeout: time.Second},
+		}
+	}
+
+	last := fakeParent(t, func(r *h.Request) (int, h.Header) {
+		return h.StatusOK, nil
+	})
+	c, e := chain(last, 0).Dial(tcp, "example.com:443")
+	require.NoError(t, e)
+	require.Equal(t, last.Host, <-dialed)
+	requireEcho(t, c)
+
+	// the last hop refuses
+	last = fakeParent(t, func(r *h.Request) (int, h.Header) {
+		return h.StatusForbidden, nil
+	})
+	_, e = chain(last, 0).Dial(tcp, "example.com:443")
+	<-dialed
+	var he *HopErr
+	require.True(t, errors.As(e, &he), fmt.Sprint(e))
+	require.Equal(t, 1, he.Hop)
+	var ce *ExpectingCodeErr
+	require.True(t, errors.As(e, &ce))
+	require.Equal(t, h.StatusForbidden, ce.Actual)
+
+	// the first hop can't reach the last
+	l, e := net.Listen(tcp, "127.0.0.1:0")
+	require.NoError(t, e)
+	last = &url.URL{Scheme: "http", Host: l.Addr().String()}
+	l.Close()
+	_, e = chain(last, 0).Dial(tcp, "example.com:443")
+	<-dialed
+	require.True(t, errors.As(e, &he), fmt.Sprint(e))
+	require.Equal(t, 0, he.Hop)
+	require.Equal(t, firstURL, he.URL)
+
+	// the last hop never answers
+	l, e = net.Listen(tcp, "127.0.0.1:0")
+	require.NoError(t, e)
+	defer l.Close()
+	go func() {
+		c, e := l.Accept()
+		if e == nil {
+			io.Copy(ioutil.Discard, c)
+			c.Close()
+		}
+	}()
+	last = &url.URL{Scheme: "http", Host: l.Addr().String()}
+	start := time.Now()
+	_, e = chain(last, 50*time.Millisecond).DialContext(
+		context.Background(), tcp, "example.com:443")
+	<-dialed
+	require.True(t, errors.As(e, &he), fmt.Sprint(e))
+	require.Equal(t, 1, he.Hop)
+	require.True(t, errors.Is(e, context.DeadlineExceeded))
+	require.True(t, time.Since(start) < 5*time.Second)
+}
+
+func TestSOCKS4(t *testing.T) {
+	ts := []struct {
+		scheme string
+		user   *url.Userinfo
+		addr   string
+		code   byte
+		// request is the expected after the port
+		request string
+		err     error
+	}{
+		{"socks4a", url.User("pepe"), "example.com:443", socks4Granted,
+			"\x00\x00\x00\x01pepe\x00example.com\x00", nil},
+		{"socks4", nil, "10.0.0.1:443", socks4Granted,
+			"\x0a\x00\x00\x01\x00", nil},
+		{"socks4a", nil, "10.0.0.1:443", socks4Rejected,
+			"\x0a\x00\x00\x01\x00",
+			&SOCKS4RejectedErr{Addr: "10.0.0.1:443", Code: 91}},
+		{"socks4a", url.User("pepe"), "example.com:443",
+			socks4NoIdentd, "\x00\x00\x00\x01pepe\x00example.com\x00",
+			&SOCKS4NoIdentdErr{Addr: "example.com:443"}},
+		{"socks4a", url.User("pepe"), "example.com:443",
+			socks4BadUserID, "\x00\x00\x00\x01pepe\x00example.com\x00",
+			&SOCKS4UserIDErr{Addr: "example.com:443"}},
+	}
+	for i, j := range ts {
+		parent := fakeSOCKS4(t, j.code, func(req []byte) {
+			require.Equal(t, "\x04\x01\x01\xbb"+j.request, string(req),
+				"At %d", i)
+		})
+		parent.Scheme, parent.User = j.scheme, j.user
+		c, e := DialProxy(tcp, j.addr, parent,
+			&IfaceDialer{Timeout: time.Second})
+		require.Equal(t, j.err, e, "At %d", i)
+		if e == nil {
+			requireEcho(t, c)
+		}
+	}
+}
+
+// fakeSOCKS4 serves a connection, checking the request with
+// check, replying with code and echoing if it's granted
+func fakeSOCKS4(t *testing.T, code byte,
+	check func([]byte)) (parent *url.URL) {
+	l, e := net.Listen(tcp, "127.0.0.1:0")
+	require.NoError(t, e)
+	go func() {
+		defer l.Close()
+		c, e := l.Accept()
+		if e != nil {
+			return
+		}
+		defer c.Close()
+		br := bufio.NewReader(c)
+		req := make([]byte, 8)
+		_, e = io.ReadFull(br, req)
+		// the user ID, and the host name with SOCKS4a
+		fields := 1
+		if e == nil && bytes.Equal(req[4:7], []byte{0, 0, 0}) {
+			fields = 2
+		}
+		for n := 0; e == nil && n != fields; n++ {
+			var s []byte
+			s, e = br.ReadBytes(0)
+			req = append(req, s...)
+		}
+		check(req)
+		c.Write([]byte{0, code, 0, 0, 0, 0, 0, 0})
+		if code == socks4Granted {
+			io.Copy(c, br)
+		}
+	}()
+	registerDialers()
+	parent = &url.URL{Scheme: "socks4", Host: l.Addr().String()}
+	return
+}
@@ -24,14 +24,35 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	fh "github.com/valyala/fasthttp"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"io"
 	"io/ioutil"
+	"log"
+	"math/big"
 	"net"
 	h "net/http"
 	ht "net/http/httptest"
+	"net/textproto"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -297,3 +318,2078 @@ type dialer struct {
 func (d *dialer) Dial(n, a string) (net.Conn, error) {
 	return d.c, nil
 }
+
+func TestSchedule(t *testing.T) {
+	loc := time.FixedZone("lab", -4*3600)
+	_, lab, e := net.ParseCIDR("10.0.0.0/24")
+	require.NoError(t, e)
+	s := &Schedule{
+		Location: loc,
+		Holidays: []time.Time{time.Date(2019, 12, 25, 0, 0, 0, 0, loc)},
+		Rules: []*ScheduleRule{
+			{
+				Clients: Clients{Ranges: []*net.IPNet{lab}},
+				Windows: []Window{
+					{Day: time.Monday, Start: 8 * time.Hour, End: 12 * time.Hour},
+					{Day: time.Monday, Start: 12 * time.Hour, End: 17 * time.Hour},
+					{Day: time.Wednesday, Start: 8 * time.Hour, End: 17 * time.Hour},
+				},
+			},
+		},
+	}
+	ts := []struct {
+		ip  string
+		t   time.Time
+		ok  bool
+		end time.Time
+	}{
+		{"10.0.0.1", time.Date(2019, 12, 23, 9, 0, 0, 0, loc), true,
+			time.Date(2019, 12, 23, 17, 0, 0, 0, loc)},
+		{"10.0.0.1", time.Date(2019, 12, 23, 17, 0, 0, 0, loc), false,
+			time.Time{}},
+		// 7:00 and 9:00 in the lab's time zone
+		{"10.0.0.1", time.Date(2019, 12, 23, 11, 0, 0, 0, time.UTC),
+			false, time.Time{}},
+		{"10.0.0.1", time.Date(2019, 12, 23, 13, 0, 0, 0, time.UTC),
+			true, time.Date(2019, 12, 23, 17, 0, 0, 0, loc)},
+		// holiday
+		{"10.0.0.1", time.Date(2019, 12, 25, 9, 0, 0, 0, loc), false,
+			time.Time{}},
+		// not restricted
+		{"10.0.1.1", time.Date(2019, 12, 25, 9, 0, 0, 0, loc), true,
+			time.Time{}},
+	}
+	for i, j := range ts {
+		end, ok := s.Allowed(&ReqParams{IP: j.ip}, j.t)
+		require.Equal(t, j.ok, ok, "At %d", i)
+		require.True(t, j.end.Equal(end), "At %d: %s", i, end)
+	}
+
+	// offsets are wall clock times on DST transition days
+	ny, e := time.LoadLocation("America/New_York")
+	require.NoError(t, e)
+	dst := &Schedule{
+		Location: ny,
+		Rules: []*ScheduleRule{{
+			Clients: Clients{Ranges: []*net.IPNet{lab}},
+			Windows: []Window{
+				{Day: time.Sunday, Start: 8 * time.Hour, End: 17 * time.Hour},
+			},
+		}},
+	}
+	end, ok := dst.Allowed(&ReqParams{IP: "10.0.0.1"},
+		time.Date(2019, 3, 10, 8, 30, 0, 0, ny))
+	require.True(t, ok)
+	require.True(t, time.Date(2019, 3, 10, 17, 0, 0, 0, ny).Equal(end),
+		"%s", end)
+
+	server := newMockConn("", false)
+	dial := s.Dialer(func(c context.Context, n,
+		a string) (net.Conn, error) {
+		return server, nil
+	})
+	ctx := context.WithValue(context.Background(), ReqParamsK,
+		&ReqParams{IP: "10.0.0.1"})
+	s.now = func() time.Time {
+		return time.Date(2019, 12, 23, 17, 0, 0, 0, loc)
+	}
+	_, e = dial(ctx, tcp, "example.com:443")
+	var oe *OutOfScheduleErr
+	require.True(t, errors.As(e, &oe))
+	require.Equal(t, "10.0.0.1", oe.IP)
+	s.now = func() time.Time {
+		return time.Date(2019, 12, 23, 17, 0, 0, 0, loc).
+			Add(-10 * time.Millisecond)
+	}
+	c, e := dial(ctx, tcp, "example.com:443")
+	require.NoError(t, e)
+	<-server.clöse
+	// closed once by the timer
+	require.NoError(t, c.Close())
+}
+
+func TestSniff(t *testing.T) {
+	hello := clientHello(t, "example.com")
+	ts := []struct {
+		content string
+		method  string
+		host    string
+	}{
+		{"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", h.MethodGet,
+			"example.com"},
+		{"POST /x HTTP/1.1\r\nHost: example.com:8080\r\n\r\nbla",
+			h.MethodPost, "example.com:8080"},
+		{string(hello), h.MethodConnect, "example.com"},
+		{"SSH-2.0-OpenSSH\r\n", h.MethodConnect, ""},
+	}
+	for i, j := range ts {
+		br := bufio.NewReader(bytes.NewBufferString(j.content))
+		method, host, e := sniff(br)
+		if j.host != "" {
+			require.NoError(t, e, "At %d", i)
+		}
+		require.Equal(t, j.method, method, "At %d", i)
+		require.Equal(t, j.host, host, "At %d", i)
+		// nothing consumed
+		require.Equal(t, len(j.content), br.Buffered(), "At %d", i)
+	}
+	_, e := parseClientHello(hello[recordHeaderLen : len(hello)-1])
+	var me *MalformedHelloErr
+	require.True(t, errors.As(e, &me))
+}
+
+func TestRelaySniffed(t *testing.T) {
+	req := "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	client, server :=
+		newMockConn(req, false),
+		newMockConn("HTTP/1.1 200 OK\r\n\r\n", false)
+	var rqp *ReqParams
+	p := NewProxy(func(c context.Context, n,
+		a string) (net.Conn, error) {
+		rqp = c.Value(ReqParamsK).(*ReqParams)
+		require.Equal(t, "93.184.216.34:80", a)
+		return server, nil
+	})
+	p.relaySniffed(client, "93.184.216.34:80")
+	<-client.clöse
+	<-server.clöse
+	require.Equal(t, "example.com:80", rqp.URL)
+	require.Equal(t, h.MethodGet, rqp.Method)
+	require.Equal(t, req, server.write.String())
+
+	// truncated ClientHellos are relayed to the original
+	// destination
+	hello := clientHello(t, "example.com")[:20]
+	client, server =
+		newMockConn(string(hello), false), newMockConn("", false)
+	p = NewProxy(func(c context.Context, n,
+		a string) (net.Conn, error) {
+		rqp = c.Value(ReqParamsK).(*ReqParams)
+		return server, nil
+	})
+	p.relaySniffed(client, "93.184.216.34:443")
+	<-client.clöse
+	<-server.clöse
+	require.Equal(t, "93.184.216.34:443", rqp.URL)
+	require.Equal(t, string(hello), server.write.String())
+
+	// connections made to the proxy itself aren't relayed
+	l, e := net.Listen(tcp, "127.0.0.1:0")
+	require.NoError(t, e)
+	defer l.Close()
+	c, e := net.Dial(tcp, l.Addr().String())
+	require.NoError(t, e)
+	defer c.Close()
+	sc, e := l.Accept()
+	require.NoError(t, e)
+	rqp = nil
+	p.relaySniffed(sc, l.Addr().String())
+	_, e = c.Read(make([]byte, 1))
+	require.Equal(t, io.EOF, e)
+	require.Nil(t, rqp)
+}
+
+// clientHello returns the TLS records with the ClientHello a
+// client sends for serverName
+func clientHello(t *testing.T, serverName string) (hello []byte) {
+	c, s := net.Pipe()
+	go tls.Client(c, &tls.Config{ServerName: serverName}).
+		Handshake()
+	hd := make([]byte, recordHeaderLen)
+	_, e := io.ReadFull(s, hd)
+	require.NoError(t, e)
+	n := int(hd[3])<<8 | int(hd[4])
+	hello = make([]byte, recordHeaderLen+n)
+	copy(hello, hd)
+	_, e = io.ReadFull(s, hello[recordHeaderLen:])
+	require.NoError(t, e)
+	s.Close()
+	c.Close()
+	return
+}
+
+func TestServeSNI(t *testing.T) {
+	hello := fragmentHello(clientHello(t, "example.com"), 50)
+	br := bufio.NewReaderSize(bytes.NewReader(hello), maxHelloSize)
+	sni, e := peekServerName(br)
+	require.NoError(t, e)
+	require.Equal(t, "example.com", sni)
+
+	l, e := net.Listen(tcp, "127.0.0.1:0")
+	require.NoError(t, e)
+	defer l.Close()
+	server := newMockConn("bla", false)
+	rqps := make(chan *ReqParams, 1)
+	p := NewProxy(func(c context.Context, n,
+		a string) (net.Conn, error) {
+		rqps <- c.Value(ReqParamsK).(*ReqParams)
+		return server, nil
+	})
+	go p.ServeSNI(l)
+	client, e := net.Dial(tcp, l.Addr().String())
+	require.NoError(t, e)
+	_, e = client.Write(hello)
+	require.NoError(t, e)
+	client.(*net.TCPConn).CloseWrite()
+	bs, e := ioutil.ReadAll(client)
+	require.NoError(t, e)
+	require.Equal(t, "bla", string(bs))
+	client.Close()
+	<-server.clöse
+	rqp := <-rqps
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	require.Equal(t, "example.com:"+port, rqp.URL)
+	require.Equal(t, h.MethodConnect, rqp.Method)
+	require.Equal(t, "127.0.0.1", rqp.IP)
+	require.Equal(t, string(hello), server.write.String())
+
+	// destinations rejected by the middlewares aren't dialed
+	blocked := make(chan string, 1)
+	p.Middlewares = []*Middleware{{
+		Connect: func(rqp *ReqParams) error {
+			blocked <- rqp.URL
+			return errors.New("blocked")
+		},
+	}}
+	client, e = net.Dial(tcp, l.Addr().String())
+	require.NoError(t, e)
+	_, e = client.Write(hello)
+	require.NoError(t, e)
+	bs, e = ioutil.ReadAll(client)
+	require.NoError(t, e)
+	require.Empty(t, bs)
+	client.Close()
+	require.Equal(t, "example.com:"+port, <-blocked)
+	require.Empty(t, rqps)
+}
+
+// fragmentHello splits the payload of a TLS record in records
+// of at most n bytes
+func fragmentHello(rec []byte, n int) (frs []byte) {
+	payload := rec[recordHeaderLen:]
+	for len(payload) != 0 {
+		m := n
+		if len(payload) < m {
+			m = len(payload)
+		}
+		frs = append(frs, rec[0], rec[1], rec[2], byte(m>>8), byte(m))
+		frs = append(frs, payload[:m]...)
+		payload = payload[m:]
+	}
+	return
+}
+
+func TestMITM(t *testing.T) {
+	origin := ht.NewTLSServer(h.HandlerFunc(
+		func(w h.ResponseWriter, r *h.Request) {
+			w.Write([]byte(r.Host + r.URL.Path))
+		}))
+	defer origin.Close()
+	var dialed []string
+	p := NewProxy(func(c context.Context, n,
+		a string) (net.Conn, error) {
+		rqp := c.Value(ReqParamsK).(*ReqParams)
+		dialed = append(dialed, rqp.Method+" "+rqp.URL)
+		return net.Dial(n, origin.Listener.Addr().String())
+	})
+	ca := newTestCA(t)
+	var e error
+	p.MITM, e = newMITM(ca)
+	require.NoError(t, e)
+	p.MITM.Hosts = []string{"example.com"}
+	p.MITM.Bypass = []string{"pinned.example.com"}
+	p.MITM.RootCAs = x509.NewCertPool()
+	p.MITM.RootCAs.AddCert(origin.Certificate())
+	require.True(t, p.MITM.Intercepts("www.example.com"))
+	require.False(t, p.MITM.Intercepts("pinned.example.com"))
+	require.False(t, p.MITM.Intercepts("example.org"))
+
+	srv := ht.NewServer(p)
+	defer srv.Close()
+	proxyURL, _ := url.Parse(srv.URL)
+	caLeaf, _ := x509.ParseCertificate(ca.Certificate[0])
+	roots := x509.NewCertPool()
+	roots.AddCert(caLeaf)
+	for _, h2 := range []bool{false, true} {
+		cl := &h.Client{
+			Transport: &h.Transport{
+				Proxy:             h.ProxyURL(proxyURL),
+				TLSClientConfig:   &tls.Config{RootCAs: roots},
+				ForceAttemptHTTP2: h2,
+			},
+		}
+		resp, e := cl.Get("https://example.com/bla")
+		require.NoError(t, e)
+		bs, e := ioutil.ReadAll(resp.Body)
+		require.NoError(t, e)
+		resp.Body.Close()
+		require.Equal(t, "example.com/bla", string(bs))
+		require.Equal(t, h2, resp.ProtoMajor == 2)
+		require.Equal(t, "example.com",
+			resp.TLS.PeerCertificates[0].Subject.CommonName)
+	}
+	// the upstream connection is reused
+	require.Equal(t, []string{"GET example.com:443"}, dialed)
+}
+
+// newTestCA returns a self signed CA certificate
+func newTestCA(t *testing.T) (ca tls.Certificate) {
+	key, e := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, e)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Proxy test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, e := x509.CreateCertificate(rand.Reader, tmpl, tmpl,
+		key.Public(), key)
+	require.NoError(t, e)
+	ca = tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return
+}
+
+func TestTLSListener(t *testing.T) {
+	ca := newTestCA(t)
+	dir, e := ioutil.TempDir("", "proxy")
+	require.NoError(t, e)
+	defer os.RemoveAll(dir)
+	certFile, keyFile :=
+		filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCert := func(serial int64) {
+		c := issueCert(t, ca, serial, "127.0.0.1", false)
+		writePEM(t, certFile, "CERTIFICATE", c.Certificate[0])
+		key, e := x509.MarshalPKCS8PrivateKey(c.PrivateKey)
+		require.NoError(t, e)
+		writePEM(t, keyFile, "PRIVATE KEY", key)
+	}
+	writeCert(2)
+	r, e := NewCertReloader(certFile, keyFile)
+	require.NoError(t, e)
+	caLeaf, _ := x509.ParseCertificate(ca.Certificate[0])
+	roots := x509.NewCertPool()
+	roots.AddCert(caLeaf)
+
+	users := make(chan string, 2)
+	p := NewProxy(func(c context.Context, n,
+		a string) (net.Conn, error) {
+		users <- c.Value(ReqParamsK).(*ReqParams).User
+		return newMockConn("HTTP/1.1 200 OK\r\n\r\n", true), nil
+	})
+	l, e := net.Listen(tcp, "127.0.0.1:0")
+	require.NoError(t, e)
+	l = tls.NewListener(l, NewTLSConfig(r, roots))
+	srv := &h.Server{Handler: p}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	proxyURL, _ := url.Parse("https://" + l.Addr().String())
+	get := func() {
+		cl := &h.Client{
+			Transport: &h.Transport{
+				Proxy: h.ProxyURL(proxyURL),
+				TLSClientConfig: &tls.Config{
+					RootCAs: roots,
+					Certificates: []tls.Certificate{
+						issueCert(t, ca, 3, "pepe", true),
+					},
+				},
+			},
+		}
+		resp, e := cl.Get("http://example.com")
+		require.NoError(t, e)
+		resp.Body.Close()
+		require.Equal(t, h.StatusOK, resp.StatusCode)
+		require.Equal(t, "pepe", <-users)
+		cl.CloseIdleConnections()
+	}
+	get()
+	writeCert(4)
+	require.NoError(t, r.Reload())
+	c, e := tls.Dial(tcp, l.Addr().String(), &tls.Config{
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{issueCert(t, ca, 5, "pepe", true)},
+	})
+	require.NoError(t, e)
+	serial := c.ConnectionState().PeerCertificates[0].SerialNumber
+	require.Equal(t, int64(4), serial.Int64())
+	c.Close()
+	get()
+}
+
+// issueCert returns a certificate signed by ca, for a server
+// with name or IP address host, or a client with common name
+// host
+func issueCert(t *testing.T, ca tls.Certificate, serial int64,
+	host string, client bool) (c tls.Certificate) {
+	caLeaf, e := x509.ParseCertificate(ca.Certificate[0])
+	require.NoError(t, e)
+	key, e := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, e)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if client {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	} else if ip := net.ParseIP(host); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{host}
+	}
+	der, e := x509.CreateCertificate(rand.Reader, tmpl, caLeaf,
+		key.Public(), ca.PrivateKey)
+	require.NoError(t, e)
+	c = tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return
+}
+
+func writePEM(t *testing.T, file, typ string, bs []byte) {
+	e := ioutil.WriteFile(file,
+		pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: bs}), 0600)
+	require.NoError(t, e)
+}
+
+func TestHTTPSParentProxy(t *testing.T) {
+	ca := newTestCA(t)
+	dir, e := ioutil.TempDir("", "proxy")
+	require.NoError(t, e)
+	defer os.RemoveAll(dir)
+	caFile, certFile, keyFile :=
+		filepath.Join(dir, "ca.pem"),
+		filepath.Join(dir, "cert.pem"),
+		filepath.Join(dir, "key.pem")
+	writePEM(t, caFile, "CERTIFICATE", ca.Certificate[0])
+	client := issueCert(t, ca, 2, "pepe", true)
+	writePEM(t, certFile, "CERTIFICATE", client.Certificate[0])
+	key, e := x509.MarshalPKCS8PrivateKey(client.PrivateKey)
+	require.NoError(t, e)
+	writePEM(t, keyFile, "PRIVATE KEY", key)
+
+	caLeaf, _ := x509.ParseCertificate(ca.Certificate[0])
+	roots := x509.NewCertPool()
+	roots.AddCert(caLeaf)
+	l, e := tls.Listen(tcp, "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{
+			issueCert(t, ca, 3, "parent.example.com", false),
+		},
+		ClientCAs:  roots,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+	})
+	require.NoError(t, e)
+	defer l.Close()
+	go func() {
+		c, e := l.Accept()
+		if e == nil {
+			br := bufio.NewReader(c)
+			r, e := h.ReadRequest(br)
+			if e == nil && r.Method == h.MethodConnect &&
+				r.Host == "example.com:443" {
+				// the destination speaks first, in the same
+				// segment as the response
+				c.Write([]byte("HTTP/1.1 200 OK\r\n" +
+					"Via: 1.1 parent\r\n\r\nhello"))
+				io.Copy(c, br)
+			}
+			c.Close()
+		}
+	}()
+
+	q := url.Values{
+		"ca":   {caFile},
+		"cert": {certFile},
+		"key":  {keyFile},
+		"sni":  {"parent.example.com"},
+	}
+	registerDialers()
+	parent := &url.URL{
+		Scheme:   "https",
+		Host:     l.Addr().String(),
+		RawQuery: q.Encode(),
+	}
+	c, e := DialProxy(tcp, "example.com:443", parent,
+		&IfaceDialer{Timeout: time.Second})
+	require.NoError(t, e)
+	pr, ok := c.(ParentResponse)
+	require.True(t, ok)
+	require.Equal(t, "1.1 parent", pr.ParentHeader().Get("Via"))
+	bs := make([]byte, 5)
+	_, e = io.ReadFull(c, bs)
+	require.NoError(t, e)
+	require.Equal(t, "hello", string(bs))
+	_, e = c.Write([]byte("bla"))
+	require.NoError(t, e)
+	bs = bs[:3]
+	_, e = io.ReadFull(c, bs)
+	require.NoError(t, e)
+	require.Equal(t, "bla", string(bs))
+	c.Close()
+}
+
+func TestDialProxyContext(t *testing.T) {
+	// a parent proxy that never answers
+	l, e := net.Listen(tcp, "127.0.0.1:0")
+	require.NoError(t, e)
+	defer l.Close()
+	go func() {
+		for {
+			c, e := l.Accept()
+			if e != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	registerDialers()
+	parent := &url.URL{Scheme: "http", Host: l.Addr().String()}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, e = DialProxyContext(ctx, tcp, "example.com:443", parent,
+		&IfaceDialer{Timeout: time.Minute})
+	require.Equal(t, context.Canceled, e)
+	require.True(t, time.Since(start) < 5*time.Second)
+
+	ctx, cancel = context.WithTimeout(context.Background(),
+		50*time.Millisecond)
+	defer cancel()
+	_, e = DialProxyContext(ctx, tcp, "example.com:443", parent,
+		&IfaceDialer{Timeout: time.Minute})
+	require.Equal(t, context.DeadlineExceeded, e)
+
+	// a dialer without DialContext blocking forever
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, e = dialContext(ctx, blockingDialer{}, tcp, "example.com:443")
+	require.Equal(t, context.Canceled, e)
+}
+
+type blockingDialer struct{}
+
+func (d blockingDialer) Dial(n, a string) (c net.Conn, e error) {
+	select {}
+}
+
+func TestUpgrade(t *testing.T) {
+	// origin switching to an echo protocol, which speaks first
+	origin := ht.NewServer(h.HandlerFunc(func(w h.ResponseWriter,
+		r *h.Request) {
+		if !isUpgrade(r.Header["Connection"],
+			r.Header.Get("Upgrade")) {
+			w.WriteHeader(h.StatusUpgradeRequired)
+			return
+		}
+		c, rw, e := w.(h.Hijacker).Hijack()
+		require.NoError(t, e)
+		defer c.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+			"Connection: Upgrade\r\nUpgrade: echo\r\n\r\nhi")
+		rw.Flush()
+		io.Copy(c, rw)
+	}))
+	defer origin.Close()
+	dial := func(ctx context.Context, n, a string) (net.Conn,
+		error) {
+		return new(net.Dialer).DialContext(ctx, n, a)
+	}
+	std := ht.NewServer(NewProxy(dial))
+	defer std.Close()
+	l, e := net.Listen(tcp, "127.0.0.1:0")
+	require.NoError(t, e)
+	defer l.Close()
+	go fh.Serve(l, NewFastProxy(dial).RequestHandler)
+
+	for _, addr := range []string{std.Listener.Addr().String(),
+		l.Addr().String()} {
+		c, e := net.Dial(tcp, addr)
+		require.NoError(t, e)
+		_, e = c.Write([]byte("GET " + origin.URL + "/ HTTP/1.1\r\n" +
+			"Host: " + origin.Listener.Addr().String() + "\r\n" +
+			"Connection: Upgrade\r\nUpgrade: echo\r\n\r\n"))
+		require.NoError(t, e)
+		br := bufio.NewReader(c)
+		resp, e := h.ReadResponse(br, nil)
+		require.NoError(t, e, addr)
+		require.Equal(t, h.StatusSwitchingProtocols, resp.StatusCode)
+		require.Equal(t, "echo", resp.Header.Get("Upgrade"))
+		bs := make([]byte, 2)
+		_, e = io.ReadFull(br, bs)
+		require.NoError(t, e)
+		require.Equal(t, "hi", string(bs))
+		_, e = c.Write([]byte("bla"))
+		require.NoError(t, e)
+		bs = make([]byte, 3)
+		_, e = io.ReadFull(br, bs)
+		require.NoError(t, e)
+		require.Equal(t, "bla", string(bs))
+		c.Close()
+
+		// requests without upgrade get the usual response
+		proxyURL, _ := url.Parse("http://" + addr)
+		cl := &h.Client{Transport: &h.Transport{
+			Proxy: h.ProxyURL(proxyURL),
+		}}
+		resp, e = cl.Get(origin.URL)
+		require.NoError(t, e)
+		resp.Body.Close()
+		require.Equal(t, h.StatusUpgradeRequired, resp.StatusCode)
+	}
+}
+
+// listenEcho returns a listener whose connections echo what
+// they read
+func listenEcho(t *testing.T) (l net.Listener) {
+	l, e := net.Listen(tcp, "127.0.0.1:0")
+	require.NoError(t, e)
+	go func() {
+		for c, e := l.Accept(); e == nil; c, e = l.Accept() {
+			go func(c net.Conn) { io.Copy(c, c); c.Close() }(c)
+		}
+	}()
+	return
+}
+
+func TestHTTP2(t *testing.T) {
+	echo := listenEcho(t)
+	defer echo.Close()
+	origin := ht.NewServer(h.HandlerFunc(func(w h.ResponseWriter,
+		r *h.Request) {
+		if r.URL.Path == "/plain" ||
+			r.Header.Get("Upgrade") != "websocket" ||
+			r.Header.Get("Sec-WebSocket-Key") == "" {
+			io.WriteString(w, "hello")
+			return
+		}
+		c, rw, e := w.(h.Hijacker).Hijack()
+		require.NoError(t, e)
+		defer c.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+			"Connection: Upgrade\r\nUpgrade: websocket\r\n" +
+			"Sec-WebSocket-Accept: bla\r\n\r\nhi")
+		rw.Flush()
+		io.Copy(c, rw)
+	}))
+	defer origin.Close()
+	originAddr := origin.Listener.Addr().String()
+	dial := func(ctx context.Context, n, a string) (net.Conn,
+		error) {
+		return new(net.Dialer).DialContext(ctx, n, a)
+	}
+	p := NewProxy(dial)
+	tlsSrv := ht.NewUnstartedServer(p)
+	tlsSrv.EnableHTTP2 = true
+	tlsSrv.StartTLS()
+	defer tlsSrv.Close()
+	h2cSrv := ht.NewServer(h2c.NewHandler(p, new(http2.Server)))
+	defer h2cSrv.Close()
+	h2cTrans := &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(n, a string, c *tls.Config) (net.Conn, error) {
+			return net.Dial(n, a)
+		},
+	}
+	for _, s := range []struct {
+		url   string
+		trans h.RoundTripper
+	}{
+		{tlsSrv.URL, tlsSrv.Client().Transport},
+		{h2cSrv.URL, h2cTrans},
+	} {
+		// tunnel relayed through the stream
+		pr, pw := io.Pipe()
+		req, e := h.NewRequest(h.MethodConnect, s.url, pr)
+		require.NoError(t, e)
+		req.Host = echo.Addr().String()
+		resp, e := s.trans.RoundTrip(req)
+		require.NoError(t, e, s.url)
+		require.Equal(t, h.StatusOK, resp.StatusCode)
+		require.Equal(t, 2, resp.ProtoMajor)
+		for _, msg := range []string{"bla", "blabla"} {
+			_, e = io.WriteString(pw, msg)
+			require.NoError(t, e)
+			bs := make([]byte, len(msg))
+			_, e = io.ReadFull(resp.Body, bs)
+			require.NoError(t, e)
+			require.Equal(t, msg, string(bs))
+		}
+		pw.Close()
+		_, e = io.Copy(ioutil.Discard, resp.Body)
+		require.NoError(t, e)
+		resp.Body.Close()
+
+		// plain requests have the destination in :authority
+		req, e = h.NewRequest(h.MethodGet, s.url+"/", nil)
+		require.NoError(t, e)
+		req.Host = originAddr
+		resp, e = s.trans.RoundTrip(req)
+		require.NoError(t, e)
+		bs, e := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, e)
+		require.Equal(t, "hello", string(bs))
+	}
+
+	// extended CONNECT, which the server only supports with
+	// GODEBUG=http2xconnect=1, thus is served directly
+	for _, path := range []string{"/chat", "/plain"} {
+		pr, pw := io.Pipe()
+		rr, rw := io.Pipe()
+		r := ht.NewRequest(h.MethodConnect, path, pr)
+		r.Host, r.Proto, r.ProtoMajor, r.ProtoMinor =
+			originAddr, "HTTP/2.0", 2, 0
+		r.Header.Set(":protocol", "websocket")
+		w := &streamRecorder{
+			header: make(h.Header),
+			status: make(chan int, 1),
+			w:      rw,
+		}
+		go func() { p.ServeHTTP(w, r); rw.Close() }()
+		if path == "/plain" {
+			// the origin answering 200 didn't switch protocols
+			require.Equal(t, h.StatusBadGateway, <-w.status)
+			continue
+		}
+		require.Equal(t, h.StatusOK, <-w.status)
+		require.Empty(t, w.header.Get("Sec-WebSocket-Accept"))
+		require.Empty(t, w.header.Get("Upgrade"))
+		bs := make([]byte, 2)
+		_, e := io.ReadFull(rr, bs)
+		require.NoError(t, e)
+		require.Equal(t, "hi", string(bs))
+		_, e = io.WriteString(pw, "bla")
+		require.NoError(t, e)
+		bs = make([]byte, 3)
+		_, e = io.ReadFull(rr, bs)
+		require.NoError(t, e)
+		require.Equal(t, "bla", string(bs))
+		pw.Close()
+		_, e = io.Copy(ioutil.Discard, rr)
+		require.NoError(t, e)
+	}
+}
+
+func TestConnectUDP(t *testing.T) {
+	udpEcho, e := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, e)
+	defer udpEcho.Close()
+	go func() {
+		bs := make([]byte, 1500)
+		n, addr, e := udpEcho.ReadFrom(bs)
+		for ; e == nil; n, addr, e = udpEcho.ReadFrom(bs) {
+			udpEcho.WriteTo(bs[:n], addr)
+		}
+	}()
+	dials := make(chan *ReqParams, 1)
+	p := NewProxy(func(ctx context.Context, n, a string) (net.Conn,
+		error) {
+		dials <- ctx.Value(ReqParamsK).(*ReqParams)
+		return new(net.Dialer).DialContext(ctx, n, a)
+	})
+	_, udpPort, _ := net.SplitHostPort(udpEcho.LocalAddr().String())
+	newRequest := func(path string) (r *h.Request) {
+		r = ht.NewRequest(h.MethodConnect, path, nil)
+		r.Host, r.Proto, r.ProtoMajor, r.ProtoMinor =
+			"proxy", "HTTP/3.0", 3, 0
+		r.Header.Set(":protocol", "connect-udp")
+		return
+	}
+
+	// writers without datagrams
+	rec := ht.NewRecorder()
+	p.ServeHTTP(rec, newRequest(udpPath+"127.0.0.1/"+udpPort+"/"))
+	require.Equal(t, h.StatusNotImplemented, rec.Code)
+
+	for _, path := range []string{
+		udpPath + "127.0.0.1/" + udpPort + "/",
+		udpPath + "127.0.0.1/",
+	} {
+		pr, pw := io.Pipe()
+		w := &datagramRecorder{
+			streamRecorder: streamRecorder{
+				header: make(h.Header),
+				status: make(chan int, 1),
+				w:      ioutil.Discard,
+			},
+			str: &fakeDatagramStream{
+				ReadCloser: pr,
+				in:         make(chan []byte),
+				out:        make(chan []byte, 1),
+			},
+		}
+		done := make(chan bool)
+		go func() { p.ServeHTTP(w, newRequest(path)); close(done) }()
+		if path == udpPath+"127.0.0.1/" {
+			require.Equal(t, h.StatusBadRequest, <-w.status)
+			<-done
+			continue
+		}
+		require.Equal(t, h.StatusOK, <-w.status)
+		require.Equal(t, "?1", w.header.Get("Capsule-Protocol"))
+		rqp := <-dials
+		require.Equal(t, "connect-udp", rqp.Protocol)
+		require.Equal(t, "127.0.0.1:"+udpPort, rqp.URL)
+		// datagrams of unknown contexts are dropped, and the
+		// context ID can have any length
+		w.str.in <- []byte("\x01bla")
+		w.str.in <- []byte("\x40\x00blabla")
+		require.Equal(t, "\x00blabla", string(<-w.str.out))
+		pw.Close()
+		<-done
+	}
+}
+
+// datagramRecorder is a streamRecorder whose request stream
+// carries datagrams
+type datagramRecorder struct {
+	streamRecorder
+	str *fakeDatagramStream
+}
+
+func (r *datagramRecorder) DatagramStream() DatagramStream {
+	return r.str
+}
+
+// fakeDatagramStream receives the datagrams sent to in, and
+// sends them to out
+type fakeDatagramStream struct {
+	io.ReadCloser
+	in, out chan []byte
+}
+
+func (s *fakeDatagramStream) SendDatagram(bs []byte) (e error) {
+	s.out <- append([]byte(nil), bs...)
+	return
+}
+
+func (s *fakeDatagramStream) ReceiveDatagram(
+	ctx context.Context) (bs []byte, e error) {
+	select {
+	case bs = <-s.in:
+	case <-ctx.Done():
+		e = ctx.Err()
+	}
+	return
+}
+
+// streamRecorder is a flushable response writer sending the
+// status to a channel and the body to w
+type streamRecorder struct {
+	header h.Header
+	status chan int
+	w      io.Writer
+}
+
+func (r *streamRecorder) Header() h.Header { return r.header }
+
+func (r *streamRecorder) WriteHeader(status int) {
+	r.status <- status
+}
+
+func (r *streamRecorder) Write(p []byte) (int, error) {
+	return r.w.Write(p)
+}
+
+func (r *streamRecorder) Flush() {}
+
+func TestRemoveHopByHop(t *testing.T) {
+	ts := []struct {
+		hd      h.Header
+		upgrade bool
+		res     h.Header
+	}{
+		{
+			hd: h.Header{
+				"Connection":          {"keep-alive, x-Hop ,, Close"},
+				"Keep-Alive":          {"timeout=5"},
+				"X-Hop":               {"bla"},
+				"Te":                  {"trailers"},
+				"Trailer":             {"Expires"},
+				"Proxy-Authorization": {"Basic cGVwZTpwYXNz"},
+				"Proxy-Connection":    {"keep-alive"},
+				"Accept":              {"text/html"},
+			},
+			res: h.Header{"Accept": {"text/html"}},
+		},
+		{
+			hd: h.Header{
+				"Connection": {"Upgrade", "X-Hop"},
+				"Upgrade":    {"websocket"},
+				"X-Hop":      {"bla"},
+				"Origin":     {"http://example.com"},
+			},
+			upgrade: true,
+			res: h.Header{
+				"Connection": {"Upgrade"},
+				"Upgrade":    {"websocket"},
+				"Origin":     {"http://example.com"},
+			},
+		},
+		{
+			hd: h.Header{
+				"Connection": {"Upgrade"},
+				"Upgrade":    {"websocket"},
+			},
+			res: h.Header{},
+		},
+	}
+	for i, j := range ts {
+		std := h.Header{}
+		copyHeader(std, j.hd)
+		removeHopByHop(stdHeader(std), j.upgrade)
+		require.Equal(t, j.res, std, "At %d", i)
+
+		req, resp := new(fh.RequestHeader), new(fh.ResponseHeader)
+		for k, vs := range j.hd {
+			for _, v := range vs {
+				req.Add(k, v)
+				resp.Add(k, v)
+			}
+		}
+		removeHopByHop(fastHd{req}, j.upgrade)
+		removeHopByHop(fastHd{resp}, j.upgrade)
+		for _, f := range []fastHeader{req, resp} {
+			res := h.Header{}
+			f.VisitAll(func(k, v []byte) {
+				if ks := string(k); ks != "Content-Type" &&
+					ks != "Content-Length" {
+					res.Add(ks, string(v))
+				}
+			})
+			require.Equal(t, j.res, res, "At %d", i)
+		}
+	}
+}
+
+func TestHeaderPolicy(t *testing.T) {
+	origin := ht.NewServer(h.HandlerFunc(func(w h.ResponseWriter,
+		r *h.Request) {
+		for _, k := range []string{"Via", "X-Forwarded-For",
+			"Forwarded"} {
+			w.Header().Set("X-Got-"+k, strings.Join(r.Header[k], ","))
+		}
+		w.Header().Set("Via", "1.1 origin")
+	}))
+	defer origin.Close()
+	ts := []struct {
+		policy *HeaderPolicy
+		via    string
+		// got are the Via, X-Forwarded-For and Forwarded
+		// headers received by the origin
+		got    []string
+		status int
+		// respVia is the Via header received by the client
+		respVia string
+	}{
+		{
+			// PSEUDONYM is replaced by the one of each proxy
+			policy:  nil,
+			got:     []string{"1.1 PSEUDONYM", "127.0.0.1", ""},
+			status:  h.StatusOK,
+			respVia: "1.1 origin, 1.1 PSEUDONYM",
+		},
+		{
+			policy: &HeaderPolicy{Pseudonym: "p0", Forwarded: true},
+			via:    "1.0 p1 (Squid)",
+			got: []string{"1.0 p1 (Squid), 1.1 p0", "",
+				"for=127.0.0.1"},
+			status:  h.StatusOK,
+			respVia: "1.1 origin, 1.1 p0",
+		},
+		{
+			policy: &HeaderPolicy{Anonymous: true, XForwardedFor: true},
+			via:    "1.1 proxy",
+			got:    []string{"", "", ""},
+			status: h.StatusOK,
+		},
+		{
+			policy: &HeaderPolicy{Pseudonym: "p0"},
+			via:    "1.0 p1, 1.1 P0",
+			status: h.StatusLoopDetected,
+		},
+	}
+	dial := func(ctx context.Context, n, a string) (net.Conn,
+		error) {
+		return new(net.Dialer).DialContext(ctx, n, a)
+	}
+	for i, j := range ts {
+		std := NewProxy(dial)
+		std.Headers = j.policy
+		stdSrv := ht.NewServer(std)
+		fast := NewFastProxy(dial)
+		fast.Headers = j.policy
+		l, e := net.Listen(tcp, "127.0.0.1:0")
+		require.NoError(t, e)
+		go fh.Serve(l, fast.RequestHandler)
+		// the default pseudonyms differ, and aren't "proxy"
+		pseudonyms := map[string]string{
+			stdSrv.Listener.Addr().String(): std.headerPolicy().pseudonym(),
+			l.Addr().String():               fast.headerPolicy().pseudonym(),
+		}
+		if j.policy == nil {
+			require.NotEqual(t, std.headerPolicy().pseudonym(),
+				fast.headerPolicy().pseudonym())
+			require.NotEqual(t, "proxy", std.headerPolicy().pseudonym())
+		}
+		for addr, pseudonym := range pseudonyms {
+			proxyURL, _ := url.Parse("http://" + addr)
+			cl := &h.Client{Transport: &h.Transport{
+				Proxy: h.ProxyURL(proxyURL),
+			}}
+			r, _ := h.NewRequest(h.MethodGet, origin.URL, nil)
+			if j.via != "" {
+				r.Header.Set("Via", j.via)
+			}
+			resp, e := cl.Do(r)
+			require.NoError(t, e)
+			resp.Body.Close()
+			require.Equal(t, j.status, resp.StatusCode, "At %d", i)
+			if j.status == h.StatusOK {
+				got := []string{
+					resp.Header.Get("X-Got-Via"),
+					resp.Header.Get("X-Got-X-Forwarded-For"),
+					resp.Header.Get("X-Got-Forwarded"),
+				}
+				want := append([]string(nil), j.got...)
+				if len(want) != 0 {
+					want[0] = strings.Replace(want[0], "PSEUDONYM",
+						pseudonym, 1)
+				}
+				require.Equal(t, want, got, "At %d", i)
+				require.Equal(t,
+					strings.Replace(j.respVia, "PSEUDONYM", pseudonym, 1),
+					resp.Header.Get("Via"), "At %d", i)
+			}
+		}
+		stdSrv.Close()
+		l.Close()
+	}
+	require.Equal(t, `for="[::1]"`, forwardedFor("::1"))
+}
+
+func TestFastProxyConcurrentDial(t *testing.T) {
+	// each client has its own address, given by the fake
+	// connection it has to the proxy, and requests a
+	// destination with it as host, served by the origin
+	ol, e := net.Listen(tcp, "127.0.0.1:0")
+	require.NoError(t, e)
+	origin := &h.Server{Handler: h.HandlerFunc(
+		func(w h.ResponseWriter, r *h.Request) {
+			w.Write([]byte(r.Host))
+		})}
+	go origin.Serve(ol)
+	defer origin.Close()
+
+	var dials, wrong int32
+	p := NewFastProxy(func(ctx context.Context, n,
+		a string) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		rqp := ctx.Value(ReqParamsK).(*ReqParams)
+		host, _, _ := net.SplitHostPort(a)
+		if host != rqp.IP || rqp.URL != a {
+			atomic.AddInt32(&wrong, 1)
+		}
+		return new(net.Dialer).DialContext(ctx, n,
+			ol.Addr().String())
+	})
+	srv := &fh.Server{Handler: p.RequestHandler}
+
+	clients, requests := 50, 20
+	var wg sync.WaitGroup
+	wg.Add(clients)
+	for i := 0; i != clients; i++ {
+		ip := net.IPv4(10, 0, 0, byte(i+2))
+		go func() {
+			defer wg.Done()
+			cl := &h.Client{Transport: &h.Transport{
+				Proxy: h.ProxyURL(&url.URL{Scheme: "http", Host: "proxy"}),
+				DialContext: func(ctx context.Context, n,
+					a string) (net.Conn, error) {
+					c, s := net.Pipe()
+					go srv.ServeConn(&remoteConn{Conn: s, ip: ip})
+					return c, nil
+				},
+			}}
+			dest := net.JoinHostPort(ip.String(), "80")
+			for j := 0; j != requests; j++ {
+				resp, e := cl.Get("http://" + dest + "/")
+				if !assert.NoError(t, e) {
+					return
+				}
+				bs, _ := ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+				assert.Equal(t, dest, string(bs))
+			}
+			cl.CloseIdleConnections()
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int32(0), wrong)
+	// connections are reused
+	require.True(t, dials < int32(clients*requests),
+		"%d dials", dials)
+}
+
+// remoteConn is a connection from a client with address ip
+type remoteConn struct {
+	net.Conn
+	ip net.IP
+}
+
+func (c *remoteConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: c.ip, Port: 1080}
+}
+
+func TestFastProxyRetry(t *testing.T) {
+	// the origin answers the first request of a connection,
+	// and closes it after reading the second one
+	ol, e := net.Listen(tcp, "127.0.0.1:0")
+	require.NoError(t, e)
+	defer ol.Close()
+	received := make(chan string, 8)
+	go func() {
+		for {
+			c, e := ol.Accept()
+			if e != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				br := bufio.NewReader(c)
+				for i := 0; i != 2; i++ {
+					r, e := h.ReadRequest(br)
+					if e != nil {
+						return
+					}
+					ioutil.ReadAll(r.Body)
+					received <- r.Method
+					if i == 0 {
+						c.Write([]byte("HTTP/1.1 200 OK\r\n" +
+							"Content-Length: 2\r\n\r\nok"))
+					}
+				}
+			}()
+		}
+	}()
+	p := NewFastProxy(func(ctx context.Context, n,
+		a string) (net.Conn, error) {
+		return new(net.Dialer).DialContext(ctx, n, a)
+	})
+	l, e := net.Listen(tcp, "127.0.0.1:0")
+	require.NoError(t, e)
+	defer l.Close()
+	go fh.Serve(l, p.RequestHandler)
+	proxyURL, _ := url.Parse("http://" + l.Addr().String())
+	cl := &h.Client{Transport: &h.Transport{Proxy: h.ProxyURL(proxyURL)}}
+	dest := "http://" + ol.Addr().String() + "/"
+
+	// a GET whose reused connection got closed is sent again
+	resp, e := cl.Get(dest)
+	require.NoError(t, e)
+	resp.Body.Close()
+	resp, e = cl.Get(dest)
+	require.NoError(t, e)
+	resp.Body.Close()
+	require.Equal(t, h.StatusOK, resp.StatusCode)
+	for i := 0; i != 3; i++ {
+		require.Equal(t, h.MethodGet, <-received)
+	}
+	// a POST isn't, since the origin may have processed it
+	resp, e = cl.Post(dest, "text/plain", strings.NewReader("bla"))
+	require.NoError(t, e)
+	resp.Body.Close()
+	require.Equal(t, h.MethodPost, <-received)
+	require.NotEqual(t, h.StatusOK, resp.StatusCode)
+	select {
+	case m := <-received:
+		t.Fatalf("%s sent again", m)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestTransportPool(t *testing.T) {
+	now := time.Now()
+	pool := &TransportPool{
+		Key:           func(r *ReqParams) string { return r.IP },
+		MaxTransports: 2,
+		IdleTimeout:   time.Minute,
+		now:           func() time.Time { return now },
+	}
+	base := new(h.Transport)
+	a0 := pool.transport(base, &ReqParams{IP: "10.0.0.1"})
+	require.True(t, a0 != base)
+	require.Equal(t, time.Minute, a0.IdleConnTimeout)
+	a1 := pool.transport(base, &ReqParams{IP: "10.0.0.1"})
+	require.True(t, a0 == a1)
+	b := pool.transport(base, &ReqParams{IP: "10.0.0.2"})
+	require.True(t, a0 != b)
+	// a different base gets different transports
+	mitm := pool.transport(new(h.Transport), &ReqParams{IP: "10.0.0.2"})
+	require.True(t, mitm != b)
+	// the least recently used is removed
+	require.Equal(t, 2, pool.Len())
+	require.True(t, a0 != pool.transport(base,
+		&ReqParams{IP: "10.0.0.1"}))
+	// unused transports are removed
+	now = now.Add(time.Minute)
+	pool.transport(base, &ReqParams{IP: "10.0.0.3"})
+	require.Equal(t, 1, pool.Len())
+
+	// connections are reused only for the same key
+	origin := &h.Server{Handler: h.HandlerFunc(
+		func(w h.ResponseWriter, r *h.Request) {
+			w.Write([]byte(r.RemoteAddr))
+		})}
+	ol, e := net.Listen(tcp, "127.0.0.1:0")
+	require.NoError(t, e)
+	go origin.Serve(ol)
+	defer origin.Close()
+	var mtx sync.Mutex
+	dialedFor := make(map[string]string)
+	p := NewProxy(func(ctx context.Context, n,
+		a string) (net.Conn, error) {
+		c, e := new(net.Dialer).DialContext(ctx, n, a)
+		if e == nil {
+			mtx.Lock()
+			dialedFor[c.LocalAddr().String()] =
+				ctx.Value(ReqParamsK).(*ReqParams).IP
+			mtx.Unlock()
+		}
+		return c, e
+	})
+	p.Pool = &TransportPool{
+		Key: func(r *ReqParams) string { return r.IP },
+	}
+	std := ht.NewServer(p)
+	defer std.Close()
+	proxyURL, _ := url.Parse(std.URL)
+	for i := 0; i != 6; i++ {
+		ip := net.IPv4(127, 0, 0, byte(i%2+2))
+		cl := &h.Client{Transport: &h.Transport{
+			Proxy: h.ProxyURL(proxyURL),
+			DialContext: (&net.Dialer{
+				LocalAddr: &net.TCPAddr{IP: ip},
+			}).DialContext,
+		}}
+		resp, e := cl.Get("http://" + ol.Addr().String())
+		require.NoError(t, e)
+		bs, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		mtx.Lock()
+		require.Equal(t, ip.String(), dialedFor[string(bs)])
+		mtx.Unlock()
+	}
+	require.Equal(t, 2, len(dialedFor))
+	require.Equal(t, 2, p.Pool.Len())
+}
+
+func TestMiddleware(t *testing.T) {
+	origin := ht.NewServer(h.HandlerFunc(func(w h.ResponseWriter,
+		r *h.Request) {
+		if r.URL.Path == "/fail" {
+			w.Header().Set("X-Fail", "1")
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer origin.Close()
+	other := ht.NewServer(h.HandlerFunc(func(w h.ResponseWriter,
+		r *h.Request) {
+		w.Write([]byte("other"))
+	}))
+	defer other.Close()
+	otherHost := other.Listener.Addr().String()
+	var mtx sync.Mutex
+	var trace []string
+	record := func(s string) {
+		mtx.Lock()
+		trace = append(trace, s)
+		mtx.Unlock()
+	}
+	fail := errors.New("fail")
+	outer := &Middleware{
+		Connect: func(rqp *ReqParams) (e error) {
+			if rqp.URL == "blocked:443" {
+				e = errors.New("blocked")
+			}
+			return
+		},
+		Request: func(r *h.Request) (resp *h.Response, e error) {
+			record("req1")
+			return
+		},
+		Response: func(resp *h.Response) (e error) {
+			record("resp1")
+			if resp.Header.Get("X-Fail") != "" {
+				e = fail
+			}
+			return
+		},
+		FastRequest: func(ctx context.Context, req *fh.Request,
+			resp *fh.Response) (ok bool, e error) {
+			record("req1")
+			return
+		},
+		FastResponse: func(ctx context.Context, req *fh.Request,
+			resp *fh.Response) (e error) {
+			record("resp1")
+			if len(resp.Header.Peek("X-Fail")) != 0 {
+				e = fail
+			}
+			return
+		},
+	}
+	inner := &Middleware{
+		Request: func(r *h.Request) (resp *h.Response, e error) {
+			record("req2")
+			switch r.URL.Path {
+			case "/blocked":
+				e = &HTTPErr{Status: h.StatusUnavailableForLegalReasons}
+			case "/synthetic":
+				resp = &h.Response{
+					StatusCode: h.StatusOK,
+					Header:     h.Header{"X-Synthetic": {"1"}},
+					Body: ioutil.NopCloser(
+						strings.NewReader("synthetic")),
+				}
+			case "/redirect":
+				r.URL.Path = "/other"
+			case "/elsewhere":
+				r.URL.Host, r.Host = otherHost, otherHost
+			case "/no-status":
+				resp = &h.Response{Body: ioutil.NopCloser(
+					strings.NewReader("synthetic"))}
+			case "/no-error-status":
+				e = &HTTPErr{}
+			}
+			return
+		},
+		Response: func(resp *h.Response) (e error) {
+			record("resp2")
+			resp.Header.Set("X-Inner", "1")
+			return
+		},
+		FastRequest: func(ctx context.Context, req *fh.Request,
+			resp *fh.Response) (ok bool, e error) {
+			record("req2")
+			switch string(req.URI().Path()) {
+			case "/blocked":
+				e = &HTTPErr{Status: h.StatusUnavailableForLegalReasons}
+			case "/synthetic":
+				resp.Header.Set("X-Synthetic", "1")
+				resp.SetBodyString("synthetic")
+				ok = true
+			case "/redirect":
+				req.URI().SetPath("/other")
+			case "/elsewhere":
+				req.URI().SetHost(otherHost)
+				req.SetHost(otherHost)
+			case "/no-status":
+				resp.SetBodyString("synthetic")
+				ok = true
+			case "/no-error-status":
+				e = &HTTPErr{}
+			}
+			return
+		},
+		FastResponse: func(ctx context.Context, req *fh.Request,
+			resp *fh.Response) (e error) {
+			record("resp2")
+			resp.Header.Set("X-Inner", "1")
+			return
+		},
+	}
+	// the dialer gets the destination set by the middlewares
+	var wrong int32
+	dial := func(ctx context.Context, n, a string) (net.Conn,
+		error) {
+		if ctx.Value(ReqParamsK).(*ReqParams).URL != a {
+			atomic.AddInt32(&wrong, 1)
+		}
+		return new(net.Dialer).DialContext(ctx, n, a)
+	}
+	std := NewProxy(dial)
+	std.Middlewares = []*Middleware{outer, inner}
+	stdSrv := ht.NewServer(std)
+	defer stdSrv.Close()
+	fast := NewFastProxy(dial)
+	fast.Middlewares = []*Middleware{outer, inner}
+	l, e := net.Listen(tcp, "127.0.0.1:0")
+	require.NoError(t, e)
+	defer l.Close()
+	go fh.Serve(l, fast.RequestHandler)
+	frontEnds := map[string]string{
+		"net/http": stdSrv.Listener.Addr().String(),
+		"fasthttp": l.Addr().String(),
+	}
+	all := []string{"req1", "req2", "resp2", "resp1"}
+	ts := []struct {
+		path   string
+		status int
+		body   string
+		trace  []string
+		inner  bool
+	}{
+		{"/", h.StatusOK, "/", all, true},
+		{"/redirect", h.StatusOK, "/other", all, true},
+		{"/synthetic", h.StatusOK, "synthetic",
+			[]string{"req1", "req2", "resp1"}, false},
+		{"/blocked", h.StatusUnavailableForLegalReasons, "",
+			[]string{"req1", "req2"}, false},
+		{"/fail", h.StatusBadGateway, "", all, false},
+		{"/elsewhere", h.StatusOK, "other", all, true},
+		{"/no-status", h.StatusOK, "synthetic",
+			[]string{"req1", "req2", "resp1"}, false},
+		{"/no-error-status", h.StatusForbidden, "",
+			[]string{"req1", "req2"}, false},
+	}
+	for name, addr := range frontEnds {
+		proxyURL, _ := url.Parse("http://" + addr)
+		cl := &h.Client{Transport: &h.Transport{
+			Proxy: h.ProxyURL(proxyURL),
+		}}
+		for _, j := range ts {
+			mtx.Lock()
+			trace = nil
+			mtx.Unlock()
+			resp, e := cl.Get(origin.URL + j.path)
+			require.NoError(t, e)
+			bs, e := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			require.NoError(t, e)
+			require.Equal(t, j.status, resp.StatusCode, name+j.path)
+			if j.status == h.StatusOK {
+				require.Equal(t, j.body, string(bs), name+j.path)
+			}
+			mtx.Lock()
+			require.Equal(t, j.trace, trace, name+j.path)
+			mtx.Unlock()
+			require.Equal(t, j.inner, resp.Header.Get("X-Inner") != "",
+				name+j.path)
+		}
+		c, e := net.Dial(tcp, addr)
+		require.NoError(t, e)
+		_, e = c.Write([]byte("CONNECT blocked:443 HTTP/1.1\r\n" +
+			"Host: blocked:443\r\n\r\n"))
+		require.NoError(t, e)
+		resp, e := h.ReadResponse(bufio.NewReader(c), nil)
+		require.NoError(t, e)
+		require.Equal(t, h.StatusForbidden, resp.StatusCode, name)
+		c.Close()
+	}
+	require.Equal(t, int32(0), wrong)
+}
+
+func TestICAP(t *testing.T) {
+	origin := ht.NewServer(h.HandlerFunc(func(w h.ResponseWriter,
+		r *h.Request) {
+		switch r.URL.Path {
+		case "/virus":
+			w.Write([]byte("EICAR test file"))
+		case "/rewritten":
+			w.Write([]byte("rewritten " + r.Header.Get("X-Icap")))
+		default:
+			bs, _ := ioutil.ReadAll(r.Body)
+			w.Write([]byte("clean " + string(bs)))
+		}
+	}))
+	defer origin.Close()
+	var mtx sync.Mutex
+	var services []string
+	l := fakeICAP(t, func(method string, req *h.Request,
+		body string) (resp string) {
+		mtx.Lock()
+		services = append(services, method+" "+req.URL.Path)
+		mtx.Unlock()
+		switch {
+		case method == "REQMOD" && req.URL.Path == "/rewrite":
+			resp = icapReply("req-hdr", "GET /rewritten HTTP/1.1\r\n"+
+				"Host: "+req.Host+"\r\nX-Icap: 1\r\n\r\n", "")
+		case method == "REQMOD" && req.URL.Path == "/denied":
+			resp = icapReply("res-hdr", "HTTP/1.1 403 Forbidden\r\n"+
+				"Content-Length: 6\r\n\r\n", "denied")
+		case method == "RESPMOD" && strings.Contains(body, "EICAR"):
+			resp = icapReply("res-hdr", "HTTP/1.1 403 Forbidden\r\n"+
+				"\r\n", "virus found")
+		default:
+			resp = "ICAP/1.0 204 No Content\r\n\r\n"
+		}
+		return
+	})
+	defer l.Close()
+	service := "icap://" + l.Addr().String()
+	icap := &ICAP{
+		ReqMod:  service + "/reqmod",
+		RespMod: service + "/respmod",
+		Preview: 4,
+		Bypass:  []string{"localhost"},
+		Timeout: 5 * time.Second,
+	}
+	p := NewProxy(func(ctx context.Context, n,
+		a string) (net.Conn, error) {
+		return new(net.Dialer).DialContext(ctx, n, a)
+	})
+	p.Middlewares = []*Middleware{icap.Middleware()}
+	std := ht.NewServer(p)
+	defer std.Close()
+	proxyURL, _ := url.Parse(std.URL)
+	cl := &h.Client{Transport: &h.Transport{
+		Proxy: h.ProxyURL(proxyURL),
+	}}
+	_, port, _ := net.SplitHostPort(origin.Listener.Addr().String())
+	ts := []struct {
+		preview  int
+		failOpen bool
+		url      string
+		body     string
+		status   int
+		resp     string
+		services []string
+	}{
+		{4, false, origin.URL + "/clean", "request body", h.StatusOK,
+			"clean request body",
+			[]string{"REQMOD /clean", "RESPMOD /clean"}},
+		{0, false, origin.URL + "/clean", "request body", h.StatusOK,
+			"clean request body",
+			[]string{"REQMOD /clean", "RESPMOD /clean"}},
+		{4, false, origin.URL + "/rewrite", "", h.StatusOK,
+			"rewritten 1",
+			[]string{"REQMOD /rewrite", "RESPMOD /rewritten"}},
+		{4, false, origin.URL + "/denied", "", h.StatusForbidden,
+			"denied", []string{"REQMOD /denied"}},
+		{4, false, origin.URL + "/virus", "", h.StatusForbidden,
+			"virus found", []string{"REQMOD /virus", "RESPMOD /virus"}},
+		{0, false, origin.URL + "/virus", "", h.StatusForbidden,
+			"virus found", []string{"REQMOD /virus", "RESPMOD /virus"}},
+		{4, false, "http://localhost:" + port + "/virus", "",
+			h.StatusOK, "EICAR test file", nil},
+	}
+	for i, j := range ts {
+		mtx.Lock()
+		services = nil
+		mtx.Unlock()
+		icap.Preview, icap.FailOpen = j.preview, j.failOpen
+		var resp *h.Response
+		var e error
+		if j.body != "" {
+			resp, e = cl.Post(j.url, "text/plain",
+				strings.NewReader(j.body))
+		} else {
+			resp, e = cl.Get(j.url)
+		}
+		require.NoError(t, e)
+		bs, e := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, e)
+		require.Equal(t, j.status, resp.StatusCode, "At %d", i)
+		require.Equal(t, j.resp, string(bs), "At %d", i)
+		mtx.Lock()
+		require.Equal(t, j.services, services, "At %d", i)
+		mtx.Unlock()
+	}
+
+	// a body bigger than ReplayLimit can't be forwarded
+	// unmodified after sending it completely, but can after
+	// the preview
+	icap.ReplayLimit = 8
+	for _, preview := range []int{0, 4} {
+		icap.Preview = preview
+		resp, e := cl.Post(origin.URL+"/clean", "text/plain",
+			strings.NewReader("request body"))
+		require.NoError(t, e)
+		bs, e := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, e)
+		if preview == 0 {
+			require.Equal(t, h.StatusBadGateway, resp.StatusCode)
+		} else {
+			require.Equal(t, "clean request body", string(bs))
+		}
+	}
+	icap.ReplayLimit = 0
+
+	// Timeout bounds each read and write, not the upload
+	icap.Preview, icap.Timeout = 0, 100*time.Millisecond
+	pr, pw := io.Pipe()
+	go func() {
+		for i := 0; i != 4; i++ {
+			time.Sleep(50 * time.Millisecond)
+			pw.Write([]byte("slow"))
+		}
+		pw.Close()
+	}()
+	resp, e := cl.Post(origin.URL+"/clean", "text/plain", pr)
+	require.NoError(t, e)
+	bs, e := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, e)
+	require.Equal(t, "clean slowslowslowslow", string(bs))
+
+	// fail policy
+	l.Close()
+	icap.FailOpen = false
+	resp, e = cl.Get(origin.URL + "/clean")
+	require.NoError(t, e)
+	resp.Body.Close()
+	require.Equal(t, h.StatusServiceUnavailable, resp.StatusCode)
+	icap.FailOpen = true
+	resp, e = cl.Post(origin.URL+"/clean", "text/plain",
+		strings.NewReader("body"))
+	require.NoError(t, e)
+	bs, e = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, e)
+	require.Equal(t, "clean body", string(bs))
+}
+
+// fakeICAP serves ICAP with respond, which gets the method and
+// the encapsulated request, and the encapsulated body. The
+// services answer after the preview when the request path is
+// /clean
+func fakeICAP(t *testing.T, respond func(method string,
+	req *h.Request, body string) string) (l net.Listener) {
+	l, e := net.Listen(tcp, "127.0.0.1:0")
+	require.NoError(t, e)
+	go func() {
+		for {
+			c, e := l.Accept()
+			if e != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				br := bufio.NewReader(c)
+				tp := textproto.NewReader(br)
+				line, e := tp.ReadLine()
+				var hd textproto.MIMEHeader
+				if e == nil {
+					hd, e = tp.ReadMIMEHeader()
+				}
+				if e != nil {
+					return
+				}
+				var offsets []int
+				var hasBody bool
+				for _, s := range strings.Split(hd.Get("Encapsulated"),
+					",") {
+					kv := strings.Split(strings.TrimSpace(s), "=")
+					n, _ := strconv.Atoi(kv[1])
+					offsets = append(offsets, n)
+					hasBody = kv[0] == "req-body" || kv[0] == "res-body"
+				}
+				blocks := make([]byte, offsets[len(offsets)-1])
+				io.ReadFull(br, blocks)
+				req, e := h.ReadRequest(bufio.NewReader(
+					bytes.NewReader(blocks)))
+				if e != nil {
+					return
+				}
+				var body string
+				if hasBody {
+					var ieof bool
+					body, ieof = readICAPChunks(br)
+					if hd.Get("Preview") != "" && !ieof &&
+						req.URL.Path != "/clean" {
+						c.Write([]byte("ICAP/1.0 100 Continue\r\n\r\n"))
+						rest, _ := readICAPChunks(br)
+						body += rest
+					}
+				}
+				c.Write([]byte(respond(strings.Fields(line)[0], req,
+					body)))
+			}()
+		}
+	}()
+	return
+}
+
+func readICAPChunks(br *bufio.Reader) (body string, ieof bool) {
+	for {
+		line, e := br.ReadString('\n')
+		if e != nil {
+			return
+		}
+		line = strings.TrimSpace(line)
+		ieof = strings.HasSuffix(line, "ieof")
+		n, _ := strconv.ParseInt(strings.Split(line, ";")[0], 16, 64)
+		chunk := make([]byte, n+2)
+		io.ReadFull(br, chunk)
+		if n == 0 {
+			return
+		}
+		body += string(chunk[:n])
+	}
+}
+
+// icapReply returns an ICAP 200 response with the header block
+// hdr, named name, followed by body when not empty
+func icapReply(name, hdr, body string) (r string) {
+	if body == "" {
+		r = fmt.Sprintf("ICAP/1.0 200 OK\r\nEncapsulated: "+
+			"%s=0, null-body=%d\r\n\r\n%s", name, len(hdr), hdr)
+	} else {
+		r = fmt.Sprintf("ICAP/1.0 200 OK\r\nEncapsulated: "+
+			"%s=0, res-body=%d\r\n\r\n%s%x\r\n%s\r\n0\r\n\r\n", name,
+			len(hdr), hdr, len(body), body)
+	}
+	return
+}
+
+func TestBodyLimits(t *testing.T) {
+	origin := ht.NewServer(h.HandlerFunc(func(w h.ResponseWriter,
+		r *h.Request) {
+		content := strings.Repeat("a", 30)
+		switch r.URL.Path {
+		case "/echo":
+			io.Copy(w, r.Body)
+		case "/small":
+			w.Write([]byte(content[:15]))
+		case "/known":
+			w.Header().Set("Content-Length", "30")
+			w.Write([]byte(content))
+		case "/chunked":
+			w.Write([]byte(content[:15]))
+			w.(h.Flusher).Flush()
+			w.Write([]byte(content[15:]))
+		}
+	}))
+	defer origin.Close()
+	_, local, _ := net.ParseCIDR("127.0.0.1/32")
+	limits := &BodyLimits{
+		Rules: []*LimitRule{
+			{
+				Clients:  Clients{Ranges: []*net.IPNet{local}},
+				Request:  10,
+				Response: 20,
+			},
+		},
+		Request:  1,
+		Response: 1,
+	}
+	dial := func(ctx context.Context, n, a string) (net.Conn,
+		error) {
+		return new(net.Dialer).DialContext(ctx, n, a)
+	}
+	logs := new(bytes.Buffer)
+	var mtx sync.Mutex
+	logger := log.New(writerFunc(func(p []byte) (int, error) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return logs.Write(p)
+	}), "", 0)
+	std := NewProxy(dial)
+	std.Limits, std.Log = limits, logger
+	stdSrv := ht.NewServer(std)
+	defer stdSrv.Close()
+	fast := NewFastProxy(dial)
+	fast.Limits, fast.Log = limits, logger
+	l, e := net.Listen(tcp, "127.0.0.1:0")
+	require.NoError(t, e)
+	defer l.Close()
+	go fh.Serve(l, fast.RequestHandler)
+	frontEnds := map[string]string{
+		"net/http": stdSrv.Listener.Addr().String(),
+		"fasthttp": l.Addr().String(),
+	}
+	for name, addr := range frontEnds {
+		proxyURL, _ := url.Parse("http://" + addr)
+		cl := &h.Client{Transport: &h.Transport{
+			Proxy: h.ProxyURL(proxyURL),
+		}}
+		ts := []struct {
+			path   string
+			body   io.Reader
+			status int
+			resp   string
+		}{
+			{"/echo", strings.NewReader("0123456789"), h.StatusOK,
+				"0123456789"},
+			{"/echo", strings.NewReader("0123456789a"),
+				h.StatusRequestEntityTooLarge, ""},
+			// unknown length
+			{"/echo", io.MultiReader(strings.NewReader("0123456789a")),
+				h.StatusRequestEntityTooLarge, ""},
+			{"/small", nil, h.StatusOK, strings.Repeat("a", 15)},
+			{"/known", nil, h.StatusBadGateway, ""},
+		}
+		for _, j := range ts {
+			var resp *h.Response
+			if j.body != nil {
+				resp, e = cl.Post(origin.URL+j.path, "text/plain", j.body)
+			} else {
+				resp, e = cl.Get(origin.URL + j.path)
+			}
+			require.NoError(t, e, name+j.path)
+			bs, e := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			require.NoError(t, e)
+			require.Equal(t, j.status, resp.StatusCode, name+j.path)
+			if j.status == h.StatusOK {
+				require.Equal(t, j.resp, string(bs))
+			}
+		}
+		resp, e := cl.Get(origin.URL + "/chunked")
+		if name == "net/http" {
+			// the connection is closed, before sending the headers
+			// or after them
+			if e == nil {
+				_, e = ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+			}
+			require.Error(t, e)
+		} else {
+			// the body is buffered before sending the response
+			require.NoError(t, e)
+			resp.Body.Close()
+			require.Equal(t, h.StatusBadGateway, resp.StatusCode)
+		}
+	}
+	mtx.Lock()
+	defer mtx.Unlock()
+	// the client retries the cut off GET
+	require.True(t, strings.Count(logs.String(),
+		"Response body exceeds the limit of 20 bytes") >= 4,
+		logs.String())
+	require.Equal(t, 4, strings.Count(logs.String(),
+		"Request body exceeds the limit of 10 bytes"), logs.String())
+
+	require.Equal(t, int64(10), limits.MaxRequest())
+	limits.Rules[0].Request = 0
+	require.Equal(t, int64(0), limits.MaxRequest())
+	require.Equal(t, int64(0), (*BodyLimits)(nil).MaxRequest())
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+func TestFastStream(t *testing.T) {
+	release, received := make(chan bool), make(chan bool)
+	var conns int32
+	origin := ht.NewUnstartedServer(h.HandlerFunc(func(
+		w h.ResponseWriter, r *h.Request) {
+		switch r.URL.Path {
+		case "/download":
+			w.Write([]byte("first "))
+			w.(h.Flusher).Flush()
+			<-release
+			w.Write([]byte("second"))
+		case "/upload":
+			buf := make([]byte, 6)
+			io.ReadFull(r.Body, buf)
+			received <- true
+			rest, _ := ioutil.ReadAll(r.Body)
+			w.Write(append(buf, rest...))
+		default:
+			w.Header().Set("Trailer", "X-Trailer")
+			w.Write([]byte(strings.Repeat("a", 30)))
+			w.(h.Flusher).Flush()
+			w.Header().Set("X-Trailer", "1")
+		}
+	}))
+	origin.Config.ConnState = func(c net.Conn, s h.ConnState) {
+		if s == h.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	origin.Start()
+	defer origin.Close()
+	p := NewFastProxy(func(ctx context.Context, n,
+		a string) (net.Conn, error) {
+		return new(net.Dialer).DialContext(ctx, n, a)
+	})
+	p.FastStream = true
+	var mtx sync.Mutex
+	logs := new(bytes.Buffer)
+	p.Log = log.New(writerFunc(func(bs []byte) (int, error) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return logs.Write(bs)
+	}), "", 0)
+	lines := func() (ls []string) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		ls = strings.Split(strings.TrimSpace(logs.String()), "\n")
+		logs.Reset()
+		return
+	}
+	l, e := net.Listen(tcp, "127.0.0.1:0")
+	require.NoError(t, e)
+	defer l.Close()
+	go (&fh.Server{
+		Handler:           p.RequestHandler,
+		StreamRequestBody: true,
+	}).Serve(l)
+	proxyURL, _ := url.Parse("http://" + l.Addr().String())
+	cl := &h.Client{Transport: &h.Transport{
+		Proxy: h.ProxyURL(proxyURL),
+	}}
+	timeout := func() <-chan time.Time {
+		return time.After(5 * time.Second)
+	}
+
+	// the first part arrives before the origin sends the second
+	resp, e := cl.Get(origin.URL + "/download")
+	require.NoError(t, e)
+	first := make(chan string)
+	go func() {
+		buf := make([]byte, 6)
+		io.ReadFull(resp.Body, buf)
+		first <- string(buf)
+	}()
+	select {
+	case s := <-first:
+		require.Equal(t, "first ", s)
+	case <-timeout():
+		t.Fatal("Response not streamed")
+	}
+	close(release)
+	bs, e := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, e)
+	require.Equal(t, "second", string(bs))
+	// logged once, after sending the body
+	require.Eventually(t, func() bool {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return logs.Len() != 0
+	}, time.Second, time.Millisecond)
+	require.Equal(t, 1, len(lines()))
+
+	// the origin gets the first part before the client sends the
+	// second
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write([]byte("first "))
+		select {
+		case <-received:
+			pw.Write([]byte("second"))
+			pw.Close()
+		case <-timeout():
+			pw.CloseWithError(errors.New("Request not streamed"))
+		}
+	}()
+	resp, e = cl.Post(origin.URL+"/upload", "text/plain", pr)
+	require.NoError(t, e)
+	bs, e = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, e)
+	require.Equal(t, "first second", string(bs))
+
+	// connections persist after chunked bodies
+	atomic.StoreInt32(&conns, 0)
+	for i := 0; i != 3; i++ {
+		resp, e = cl.Get(origin.URL + "/chunked")
+		require.NoError(t, e)
+		bs, e = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, e)
+		require.Equal(t, 30, len(bs))
+	}
+	// the first may reuse the connection of the upload
+	require.True(t, atomic.LoadInt32(&conns) <= 1)
+
+	// limits
+	p.Limits = &BodyLimits{Request: 10, Response: 20}
+	lines()
+	resp, e = cl.Get(origin.URL + "/chunked")
+	if e == nil {
+		_, e = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	require.Error(t, e)
+	// each try, since the client retries, is logged once as
+	// cut off
+	for _, l := range lines() {
+		require.Contains(t, l, "Response body exceeds the limit")
+	}
+	resp, e = cl.Post(origin.URL+"/upload", "text/plain",
+		io.MultiReader(strings.NewReader(strings.Repeat("a", 30))))
+	require.NoError(t, e)
+	resp.Body.Close()
+	require.Equal(t, h.StatusRequestEntityTooLarge, resp.StatusCode)
+}
+
+// BenchmarkTransfer downloads and uploads 1 GB through the
+// net/http front end, and the fasthttp one streaming bodies
+func BenchmarkTransfer(b *testing.B) {
+	const size = 1 << 30
+	origin := ht.NewServer(h.HandlerFunc(func(w h.ResponseWriter,
+		r *h.Request) {
+		if r.Method == h.MethodPost {
+			n, _ := io.Copy(ioutil.Discard, r.Body)
+			fmt.Fprint(w, n)
+		} else {
+			w.Header().Set("Content-Length", strconv.Itoa(size))
+			io.CopyN(w, zeros{}, size)
+		}
+	}))
+	defer origin.Close()
+	dial := func(ctx context.Context, n, a string) (net.Conn,
+		error) {
+		return new(net.Dialer).DialContext(ctx, n, a)
+	}
+	std := ht.NewServer(NewProxy(dial))
+	defer std.Close()
+	fast := NewFastProxy(dial)
+	fast.FastStream = true
+	l, e := net.Listen(tcp, "127.0.0.1:0")
+	require.NoError(b, e)
+	defer l.Close()
+	go (&fh.Server{
+		Handler:           fast.RequestHandler,
+		StreamRequestBody: true,
+	}).Serve(l)
+	frontEnds := []struct{ name, addr string }{
+		{"net/http", std.Listener.Addr().String()},
+		{"fasthttp streams", l.Addr().String()},
+	}
+	for _, j := range frontEnds {
+		proxyURL, _ := url.Parse("http://" + j.addr)
+		cl := &h.Client{Transport: &h.Transport{
+			Proxy: h.ProxyURL(proxyURL),
+		}}
+		b.Run(j.name+"/download", func(b *testing.B) {
+			b.SetBytes(size)
+			b.ReportAllocs()
+			for i := 0; i != b.N; i++ {
+				resp, e := cl.Get(origin.URL)
+				require.NoError(b, e)
+				n, e := io.Copy(ioutil.Discard, resp.Body)
+				resp.Body.Close()
+				require.NoError(b, e)
+				require.Equal(b, int64(size), n)
+			}
+		})
+		b.Run(j.name+"/upload", func(b *testing.B) {
+			b.SetBytes(size)
+			b.ReportAllocs()
+			for i := 0; i != b.N; i++ {
+				resp, e := cl.Post(origin.URL, "application/octet-stream",
+					io.LimitReader(zeros{}, size))
+				require.NoError(b, e)
+				bs, e := ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+				require.NoError(b, e)
+				require.Equal(b, strconv.Itoa(size), string(bs))
+			}
+		})
+	}
+}
+
+type zeros struct{}
+
+func (zeros) Read(p []byte) (n int, e error) {
+	for i := range p {
+		p[i] = 0
+	}
+	n = len(p)
+	return
+}
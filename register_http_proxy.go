@@ -22,49 +22,291 @@ package proxy
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
+	"sync"
 
 	"golang.org/x/net/proxy"
 )
 
+var registerOnce sync.Once
+
+// registerDialers makes available the "http", "https",
+// "socks4" and "socks4a" parent proxy schemes to
+// golang.org/x/net/proxy.FromURL
+func registerDialers() {
+	registerOnce.Do(func() {
+		proxy.RegisterDialerType("http", newHTTPProxy)
+		proxy.RegisterDialerType("https", newHTTPSProxy)
+		proxy.RegisterDialerType("socks4", newSOCKS4Proxy)
+		proxy.RegisterDialerType("socks4a", newSOCKS4aProxy)
+	})
+}
+
 // httpProxy is a HTTP/HTTPS connect proxy.
 type httpProxy struct {
-	host     string
-	haveAuth bool
-	username string
-	password string
-	forward  proxy.Dialer
+	uri     *url.URL
+	host    string
+	forward proxy.Dialer
+	// tlsConfig, when not nil, is used for connecting to the
+	// proxy with TLS
+	tlsConfig *tls.Config
 }
 
 func newHTTPProxy(uri *url.URL,
 	forward proxy.Dialer) (dlr proxy.Dialer, e error) {
 	s := new(httpProxy)
-	s.host = uri.Host
+	s.uri = uri
+	s.host = hostWithPort(uri.Host, ":80")
 	s.forward = forward
-	if uri.User != nil {
-		s.haveAuth = true
-		s.username = uri.User.Username()
-		s.password, _ = uri.User.Password()
-	}
 	dlr = s
 	return
 }
 
+// newHTTPSProxy creates a dialer for a proxy reached with TLS.
+// The query of uri can have the parameters:
+//   - ca: file with the CA certificates for verifying the
+//     proxy, instead of the system ones
+//   - sni: server name sent to the proxy and verified in its
+//     certificate, instead of the URL host
+//   - cert and key: files with the client certificate
+func newHTTPSProxy(uri *url.URL,
+	forward proxy.Dialer) (dlr proxy.Dialer, e error) {
+	var tc *tls.Config
+	tc, e = parentTLSConfig(uri)
+	if e == nil {
+		dlr, e = newHTTPProxy(uri, forward)
+	}
+	if e == nil {
+		s := dlr.(*httpProxy)
+		s.host = hostWithPort(uri.Host, ":443")
+		s.tlsConfig = tc
+	}
+	return
+}
+
+func parentTLSConfig(uri *url.URL) (c *tls.Config, e error) {
+	q := uri.Query()
+	c = &tls.Config{ServerName: uri.Hostname()}
+	if sni := q.Get("sni"); sni != "" {
+		c.ServerName = sni
+	}
+	if ca := q.Get("ca"); ca != "" {
+		var bs []byte
+		bs, e = ioutil.ReadFile(ca)
+		c.RootCAs = x509.NewCertPool()
+		if e == nil && !c.RootCAs.AppendCertsFromPEM(bs) {
+			e = fmt.Errorf("No certificates in '%s'", ca)
+		}
+	}
+	if cert := q.Get("cert"); e == nil && cert != "" {
+		var kp tls.Certificate
+		kp, e = tls.LoadX509KeyPair(cert, q.Get("key"))
+		c.Certificates = []tls.Certificate{kp}
+	}
+	return
+}
+
 func (s *httpProxy) Dial(network,
 	addr string) (net.Conn, error) {
-	// Dial and create the https client connection.
-	c, err := s.forward.Dial(tcp, s.host)
+	return s.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to addr through the proxy,
+// authenticating when it answers 407 with a supported scheme.
+// When ctx is done before the proxy accepts the CONNECT
+// request, the connection is closed and ctx.Err() is returned
+func (s *httpProxy) DialContext(ctx context.Context, network,
+	addr string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, fmt.Errorf("Network '%s' not supported by HTTP "+
+			"proxies", network)
+	}
+	pc, err := s.open(ctx)
 	if err != nil {
 		return nil, err
 	}
+	resp, err := pc.connect(addr, s.basicAuth())
+	var session AuthSession
+	ended := false
+	for round := 0; err == nil && !ended && round != maxAuthRounds &&
+		resp.StatusCode == http.StatusProxyAuthRequired; round++ {
+		if session == nil {
+			session, err = s.newSession(resp.Header, addr)
+		}
+		var auth string
+		if err == nil && session != nil {
+			auth, err = session.Next(
+				challenge(resp.Header, session.Scheme()))
+		}
+		ended = auth == ""
+		if err == nil && !ended && resp.Close {
+			pc.close()
+			pc, err = s.open(ctx)
+		}
+		if err == nil && !ended {
+			resp, err = pc.connect(addr, auth)
+		}
+	}
+	if err == nil && resp.StatusCode == http.StatusProxyAuthRequired {
+		err = &ProxyAuthErr{
+			Challenges: resp.Header["Proxy-Authenticate"],
+		}
+	} else if err == nil && resp.StatusCode != http.StatusOK {
+		err = &ExpectingCodeErr{
+			Context:  "Connect server using proxy error",
+			Expected: http.StatusOK,
+			Actual:   resp.StatusCode,
+		}
+	}
+	if pc == nil {
+		return nil, err
+	}
+	if e := pc.stop(); e != nil {
+		// ctx was done, and that was the cause of err if any
+		err = e
+	}
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	tc := &tunnelConn{Conn: pc.Conn, br: pc.br, header: resp.Header}
+	return tc, nil
+}
 
+// ParentResponse is implemented by the connections returned
+// by the "http" and "https" parent proxy dialers
+type ParentResponse interface {
+	// ParentHeader returns the headers of the parent proxy
+	// response to the CONNECT request
+	ParentHeader() http.Header
+}
+
+// tunnelConn is a connection established through a parent
+// proxy. Reading it returns first the bytes sent by the proxy
+// after the CONNECT response, buffered while reading it
+type tunnelConn struct {
+	net.Conn
+	br     *bufio.Reader
+	header http.Header
+}
+
+func (c *tunnelConn) Read(p []byte) (n int, e error) {
+	n, e = c.br.Read(p)
+	return
+}
+
+func (c *tunnelConn) ParentHeader() (hd http.Header) {
+	hd = c.header
+	return
+}
+
+// maxAuthRounds bounds the requests sent to a proxy
+// answering 407
+const maxAuthRounds = 5
+
+// basicAuth returns the Basic Proxy-Authorization value for
+// the credentials in the proxy URL, if any
+func (s *httpProxy) basicAuth() (auth string) {
+	if s.uri.User != nil {
+		pass, _ := s.uri.User.Password()
+		auth = basicAuth(s.uri.User.Username(), pass)
+	}
+	return
+}
+
+// credentials returns the user and password in the proxy URL,
+// or supplied by ParentCredentials
+func (s *httpProxy) credentials() (user, pass string, ok bool,
+	e error) {
+	if s.uri.User != nil {
+		user = s.uri.User.Username()
+		pass, _ = s.uri.User.Password()
+		ok = true
+	} else if ParentCredentials != nil {
+		user, pass, e = ParentCredentials(s.uri)
+		ok = e == nil
+	}
+	return
+}
+
+// newSession returns a session for the preferred scheme among
+// the offered in hd, or nil when none is supported. The
+// preference is Negotiate, NTLM, Digest and Basic
+func (s *httpProxy) newSession(hd http.Header,
+	addr string) (a AuthSession, e error) {
+	if offers(hd, "Negotiate") && NegotiateProvider != nil {
+		a, e = NegotiateProvider(s.uri)
+	} else {
+		var user, pass string
+		var ok bool
+		user, pass, ok, e = s.credentials()
+		if ok && offers(hd, "NTLM") {
+			a = newNTLMSession(user, pass)
+		} else if ok && offers(hd, "Digest") {
+			a = &digestSession{
+				user:     user,
+				password: pass,
+				method:   http.MethodConnect,
+				uri:      addr,
+			}
+		} else if ok && offers(hd, "Basic") {
+			// credentials in the URL were sent already
+			a = &basicSession{
+				user:     user,
+				password: pass,
+				sent:     s.uri.User != nil,
+			}
+		}
+	}
+	return
+}
+
+// parentConn is a connection to a parent proxy, whose
+// operations fail when the context passed to open is done
+type parentConn struct {
+	net.Conn
+	br   *bufio.Reader
+	stop func() error
+}
+
+// open dials the proxy, with TLS if configured
+func (s *httpProxy) open(ctx context.Context) (*parentConn,
+	error) {
+	c, err := dialContext(ctx, s.forward, tcp, s.host)
+	if err != nil {
+		return nil, err
+	}
+	stop := watchContext(ctx, c)
+	if s.tlsConfig != nil {
+		tc := tls.Client(c, s.tlsConfig)
+		if err = tc.Handshake(); err != nil {
+			if e := stop(); e != nil {
+				err = e
+			}
+			c.Close()
+			return nil, err
+		}
+		c = tc
+	}
+	pc := &parentConn{Conn: c, br: bufio.NewReader(c), stop: stop}
+	return pc, nil
+}
+
+// connect sends the CONNECT request for addr, with auth as
+// Proxy-Authorization when not empty, and reads the response
+func (pc *parentConn) connect(addr,
+	auth string) (*http.Response, error) {
 	// HACK. http.ReadRequest also does this.
 	reqURL, err := url.Parse("https://" + addr)
 	if err != nil {
-		c.Close()
 		return nil, err
 	}
 	reqURL.Scheme = ""
@@ -72,39 +314,37 @@ func (s *httpProxy) Dial(network,
 	req, err := http.NewRequest(http.MethodConnect,
 		reqURL.String(), nil)
 	if err != nil {
-		c.Close()
 		return nil, err
 	}
 	req.Close = false
-	if s.haveAuth {
-		req.SetBasicAuth(s.username, s.password)
+	if auth != "" {
+		req.Header.Set("Proxy-Authorization", auth)
 	}
-	// req.Header.Set("User-Agent", "Powerby Gota")
 
-	err = req.Write(c)
+	err = req.Write(pc)
 	if err != nil {
-		c.Close()
 		return nil, err
 	}
 
-	resp, err := http.ReadResponse(bufio.NewReader(c), req)
+	resp, err := http.ReadResponse(pc.br, req)
 	if err != nil {
-		// TODO close resp body ?
-		//resp.Body.Close()
-		c.Close()
 		return nil, err
 	}
-	resp.Body.Close()
+	// the body of responses other than 200 must be consumed
+	// for sending another request through the connection,
+	// while after 200 the tunnel starts, even if the headers
+	// announce a body, as net/http.Server does
 	if resp.StatusCode != http.StatusOK {
-		c.Close()
-		err = &ExpectingCodeErr{
-			Context:  "Connect server using proxy error",
-			Expected: http.StatusOK,
-			Actual:   resp.StatusCode,
-		}
-		return nil, err
+		_, err = io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
 	}
-	return c, nil
+	return resp, err
+}
+
+// close stops watching the context and closes the connection
+func (pc *parentConn) close() {
+	pc.stop()
+	pc.Close()
 }
 
 type ExpectingCodeErr struct {
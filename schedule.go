@@ -0,0 +1,244 @@
+// Copyright © 2018-2019 Luis Ángel Méndez Gort
+
+// This file is part of Proxy.
+
+// Proxy is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General
+// Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your
+// option) any later version.
+
+// Proxy is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the
+// implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU Lesser General Public
+// License for more details.
+
+// You should have received a copy of the GNU Lesser General
+// Public License along with Proxy.  If not, see
+// <https://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	alg "github.com/lamg/algorithms"
+)
+
+// Clients matches requests by the IP range of the client
+// or by its user name
+type Clients struct {
+	Ranges []*net.IPNet
+	Users  []string
+}
+
+// Match returns whether the client that made the request
+// belongs to any of the ranges, or has any of the user names
+func (c *Clients) Match(rqp *ReqParams) (ok bool) {
+	ip := net.ParseIP(rqp.IP)
+	ok, _ = alg.BLnSrch(
+		func(i int) bool { return c.Ranges[i].Contains(ip) },
+		len(c.Ranges),
+	)
+	if !ok && rqp.User != "" {
+		ok, _ = alg.BLnSrch(
+			func(i int) bool { return c.Users[i] == rqp.User },
+			len(c.Users),
+		)
+	}
+	return
+}
+
+// Window is a weekly time window. Start and End are offsets
+// from the midnight of Day, and End can be at most 24 hours
+type Window struct {
+	Day   time.Weekday
+	Start time.Duration
+	End   time.Duration
+}
+
+// ScheduleRule associates the matched clients to the windows
+// when they are allowed to connect
+type ScheduleRule struct {
+	Clients
+	Windows []Window
+}
+
+// Schedule restricts clients to weekly time windows,
+// evaluated in Location (UTC when nil). During Holidays no
+// window is open. Clients are checked against the first rule
+// that matches them, and those not matched by any rule
+// aren't restricted
+type Schedule struct {
+	Rules    []*ScheduleRule
+	Location *time.Location
+	// Holidays are compared by date in Location
+	Holidays []time.Time
+
+	now func() time.Time
+}
+
+// Allowed returns whether the client that made the request
+// can connect at t, and in that case the moment when the
+// current window closes. The latter is the zero time when the
+// client isn't restricted
+func (s *Schedule) Allowed(rqp *ReqParams,
+	t time.Time) (end time.Time, ok bool) {
+	var rule *ScheduleRule
+	alg.BLnSrch(
+		func(i int) (b bool) {
+			b = s.Rules[i].Match(rqp)
+			if b {
+				rule = s.Rules[i]
+			}
+			return
+		},
+		len(s.Rules),
+	)
+	ok = rule == nil
+	if !ok {
+		end, ok = s.windowEnd(rule, t)
+	}
+	return
+}
+
+// windowEnd returns the end of the window containing t,
+// joining the contiguous windows that follow it
+func (s *Schedule) windowEnd(rule *ScheduleRule,
+	t time.Time) (end time.Time, ok bool) {
+	end, ok = s.openAt(rule, t)
+	// a week of contiguous windows never closes, and then end
+	// is left a week after t
+	week := 7 * 24 * time.Hour
+	for open := ok; open && end.Sub(t) <= week; {
+		var next time.Time
+		next, open = s.openAt(rule, end)
+		if open {
+			end = next
+		}
+	}
+	return
+}
+
+func (s *Schedule) openAt(rule *ScheduleRule,
+	t time.Time) (end time.Time, ok bool) {
+	loc := s.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	lt := t.In(loc)
+	y, m, d := lt.Date()
+	// offsets are wall clock times, which differ from the
+	// time elapsed since midnight on DST transition days
+	hour, minute, sec := lt.Clock()
+	offset := time.Duration(hour)*time.Hour +
+		time.Duration(minute)*time.Minute +
+		time.Duration(sec)*time.Second +
+		time.Duration(lt.Nanosecond())
+	holiday, _ := alg.BLnSrch(
+		func(i int) bool {
+			hy, hm, hd := s.Holidays[i].In(loc).Date()
+			return hy == y && hm == m && hd == d
+		},
+		len(s.Holidays),
+	)
+	if !holiday {
+		ok, _ = alg.BLnSrch(
+			func(i int) (b bool) {
+				w := rule.Windows[i]
+				b = w.Day == lt.Weekday() && w.Start <= offset &&
+					offset < w.End
+				if b {
+					end = time.Date(y, m, d, int(w.End/time.Hour),
+						int(w.End%time.Hour/time.Minute),
+						int(w.End%time.Minute/time.Second),
+						int(w.End%time.Second), loc)
+				}
+				return
+			},
+			len(rule.Windows),
+		)
+	}
+	return
+}
+
+// Dialer returns a Dialer that rejects with *OutOfScheduleErr
+// the requests made outside the allowed windows, and otherwise
+// dials with d. The connections it returns are closed when the
+// window they were dialed in ends, so active CONNECT tunnels
+// don't outlive it
+func (s *Schedule) Dialer(d Dialer) Dialer {
+	return func(ctx context.Context, network,
+		addr string) (c net.Conn, e error) {
+		rqp, _ := ctx.Value(ReqParamsK).(*ReqParams)
+		if rqp == nil {
+			rqp = new(ReqParams)
+		}
+		now := time.Now
+		if s.now != nil {
+			now = s.now
+		}
+		t := now()
+		end, ok := s.Allowed(rqp, t)
+		if !ok {
+			e = &OutOfScheduleErr{IP: rqp.IP, User: rqp.User, Time: t}
+		}
+		if e == nil {
+			c, e = d(ctx, network, addr)
+		}
+		if e == nil && !end.IsZero() {
+			c = newScheduledConn(c, end.Sub(t))
+		}
+		return
+	}
+}
+
+// scheduledConn is closed when its timer fires
+type scheduledConn struct {
+	net.Conn
+	timer *time.Timer
+	once  sync.Once
+	err   error
+}
+
+func newScheduledConn(c net.Conn,
+	d time.Duration) (s *scheduledConn) {
+	s = &scheduledConn{Conn: c}
+	s.timer = time.AfterFunc(d, func() { s.close() })
+	return
+}
+
+func (s *scheduledConn) Close() (e error) {
+	s.timer.Stop()
+	e = s.close()
+	return
+}
+
+func (s *scheduledConn) close() (e error) {
+	s.once.Do(func() { s.err = s.Conn.Close() })
+	e = s.err
+	return
+}
+
+// OutOfScheduleErr is returned when a client tries to connect
+// outside the windows its schedule allows
+type OutOfScheduleErr struct {
+	IP   string
+	User string
+	Time time.Time
+}
+
+func (e *OutOfScheduleErr) Error() (s string) {
+	client := e.IP
+	if e.User != "" {
+		client = e.User
+	}
+	s = fmt.Sprintf("Client '%s' out of schedule at %s", client,
+		e.Time.Format(time.RFC3339))
+	return
+}
@@ -0,0 +1,69 @@
+// Copyright © 2018-2019 Luis Ángel Méndez Gort
+
+// This file is part of Proxy.
+
+// Proxy is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General
+// Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your
+// option) any later version.
+
+// Proxy is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the
+// implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU Lesser General Public
+// License for more details.
+
+// You should have received a copy of the GNU Lesser General
+// Public License along with Proxy.  If not, see
+// <https://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"bufio"
+	"net"
+	h "net/http"
+	"time"
+)
+
+// ServeSNI accepts TLS connections on l and relays them,
+// without decrypting, to the server named in their ClientHello
+// at the port where they were accepted. The dialer receives
+// the server name and port in ReqParams.URL, and CONNECT as
+// method. Connections without server name are closed
+func (p *Proxy) ServeSNI(l net.Listener) (e error) {
+	for e == nil {
+		var c net.Conn
+		c, e = l.Accept()
+		if e == nil {
+			go p.serveSNI(c)
+		}
+	}
+	return
+}
+
+func (p *Proxy) serveSNI(client net.Conn) {
+	br := bufio.NewReaderSize(client, maxHelloSize)
+	client.SetReadDeadline(time.Now().Add(sniffTimeout))
+	sni, e := peekServerName(br)
+	client.SetReadDeadline(time.Time{})
+	if e == nil && sni == "" {
+		e = malformedHello("no server name")
+	}
+	var port string
+	if e == nil {
+		_, port, e = net.SplitHostPort(client.LocalAddr().String())
+	}
+	if e == nil {
+		addr := net.JoinHostPort(sni, port)
+		i := &ReqParams{
+			Method: h.MethodConnect,
+			URL:    addr,
+			IP:     remoteIP(client),
+		}
+		p.relayPeeked(client, br, i, addr)
+	} else {
+		client.Close()
+	}
+}
@@ -0,0 +1,237 @@
+// Copyright © 2018-2019 Luis Ángel Méndez Gort
+
+// This file is part of Proxy.
+
+// Proxy is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General
+// Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your
+// option) any later version.
+
+// Proxy is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the
+// implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU Lesser General Public
+// License for more details.
+
+// You should have received a copy of the GNU Lesser General
+// Public License along with Proxy.  If not, see
+// <https://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	h "net/http"
+	"strings"
+)
+
+const (
+	// maxHelloSize is the buffer size for peeking ClientHello
+	// messages
+	maxHelloSize        = 1 << 16
+	recordHeaderLen     = 5
+	recordTypeHandshake = 0x16
+	typeClientHello     = 1
+	extServerName       = 0
+)
+
+// sniff peeks at the start of a connection, without consuming
+// it, for the TLS ClientHello server name or the HTTP Host
+// header. The returned method is the HTTP request method, or
+// CONNECT for TLS and other protocols. The host is empty when
+// it cannot be determined
+func sniff(br *bufio.Reader) (method, host string, e error) {
+	var first []byte
+	first, e = br.Peek(1)
+	if e == nil && first[0] == recordTypeHandshake {
+		method = h.MethodConnect
+		host, e = peekServerName(br)
+	} else if e == nil {
+		method, host, e = peekHTTPHost(br)
+	}
+	return
+}
+
+// peekServerName returns the server name indication sent in
+// the ClientHello at the start of br. The ClientHello can be
+// fragmented in several records, and all of them must fit in
+// the buffer of br
+func peekServerName(br *bufio.Reader) (sni string, e error) {
+	// msg accumulates the fragments of the handshake message
+	// until having the 4 bytes header, and then its length
+	var msg []byte
+	off, need := 0, 4
+	for e == nil && len(msg) < need {
+		var rec []byte
+		rec, e = br.Peek(off + recordHeaderLen)
+		if e == nil && rec[off] != recordTypeHandshake {
+			e = malformedHello("not a handshake record")
+		}
+		if e == nil {
+			n := int(binary.BigEndian.Uint16(rec[off+3 : off+5]))
+			rec, e = br.Peek(off + recordHeaderLen + n)
+			if e == nil {
+				msg = append(msg, rec[off+recordHeaderLen:]...)
+				off = len(rec)
+			}
+		}
+		if e == nil && len(msg) >= 4 {
+			need = 4 + (&helloReader{b: msg[1:4]}).u24()
+		}
+	}
+	if e == nil {
+		sni, e = parseClientHello(msg[:need])
+	}
+	return
+}
+
+// parseClientHello extracts the server name from a complete
+// ClientHello handshake message
+func parseClientHello(msg []byte) (sni string, e error) {
+	s := &helloReader{b: msg}
+	if s.u8() != typeClientHello {
+		e = malformedHello("not a ClientHello")
+	}
+	if e == nil && s.u24() != len(s.b) {
+		e = malformedHello("wrong handshake length")
+	}
+	if e == nil {
+		s.skip(2 + 32)  // version and random
+		s.skip(s.u8())  // session id
+		s.skip(s.u16()) // cipher suites
+		s.skip(s.u8())  // compression methods
+		exts := &helloReader{b: s.bytes(s.u16())}
+		for e == nil && !s.bad && !exts.bad && len(exts.b) != 0 {
+			typ, data := exts.u16(), exts.bytes(exts.u16())
+			if typ == extServerName && !exts.bad {
+				sni, e = parseServerName(data)
+			}
+		}
+		if s.bad || exts.bad {
+			e = malformedHello("truncated message")
+		}
+	}
+	return
+}
+
+func parseServerName(data []byte) (sni string, e error) {
+	names := &helloReader{b: data}
+	list := &helloReader{b: names.bytes(names.u16())}
+	for sni == "" && !list.bad && len(list.b) != 0 {
+		typ, name := list.u8(), list.bytes(list.u16())
+		if typ == 0 && !list.bad {
+			sni = string(name)
+		}
+	}
+	if names.bad || list.bad {
+		e = malformedHello("truncated server name")
+	}
+	return
+}
+
+// helloReader reads big endian integers and length prefixed
+// vectors, setting bad when there are not enough bytes
+type helloReader struct {
+	b   []byte
+	bad bool
+}
+
+func (r *helloReader) bytes(n int) (bs []byte) {
+	if n <= len(r.b) {
+		bs, r.b = r.b[:n], r.b[n:]
+	} else {
+		r.bad, r.b = true, nil
+	}
+	return
+}
+
+func (r *helloReader) skip(n int) {
+	r.bytes(n)
+}
+
+func (r *helloReader) u8() (n int) {
+	if bs := r.bytes(1); len(bs) == 1 {
+		n = int(bs[0])
+	}
+	return
+}
+
+func (r *helloReader) u16() (n int) {
+	if bs := r.bytes(2); len(bs) == 2 {
+		n = int(binary.BigEndian.Uint16(bs))
+	}
+	return
+}
+
+func (r *helloReader) u24() (n int) {
+	if bs := r.bytes(3); len(bs) == 3 {
+		n = int(bs[0])<<16 | int(bs[1])<<8 | int(bs[2])
+	}
+	return
+}
+
+// peekHTTPHost returns the method and Host header of the
+// HTTP request at the start of br, or empty strings if there
+// isn't one
+func peekHTTPHost(br *bufio.Reader) (method, host string,
+	e error) {
+	var hd []byte
+	end := -1
+	for e == nil && end == -1 && br.Buffered() < br.Size() {
+		// peeking one byte more than buffered reads at least
+		// one more from the connection
+		hd, e = br.Peek(br.Buffered() + 1)
+		end = bytes.Index(hd, []byte("\r\n\r\n"))
+	}
+	if end != -1 {
+		// an error after the headers shows up again when
+		// relaying the connection
+		e = nil
+		hr := bufio.NewReader(bytes.NewReader(hd[:end+4]))
+		r, re := h.ReadRequest(hr)
+		if re == nil {
+			method, host = r.Method, r.Host
+		}
+	}
+	if method == "" {
+		method = h.MethodConnect
+	}
+	return
+}
+
+// hostWithPort adds the port of addr to host, when host
+// hasn't one. It returns addr if host is empty
+func hostWithPort(host, addr string) (hp string) {
+	hp = addr
+	if host != "" {
+		hp = host
+		if _, _, e := net.SplitHostPort(host); e != nil {
+			_, port, _ := net.SplitHostPort(addr)
+			// IPv6 literals without port are still bracketed
+			ip := strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+			hp = net.JoinHostPort(ip, port)
+		}
+	}
+	return
+}
+
+// MalformedHelloErr is returned when a TLS ClientHello cannot
+// be parsed
+type MalformedHelloErr struct {
+	Reason string
+}
+
+func (e *MalformedHelloErr) Error() (s string) {
+	s = fmt.Sprintf("Malformed ClientHello: %s", e.Reason)
+	return
+}
+
+func malformedHello(reason string) (e error) {
+	e = &MalformedHelloErr{Reason: reason}
+	return
+}
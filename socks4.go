@@ -0,0 +1,217 @@
+// Copyright © 2018-2019 Luis Ángel Méndez Gort
+
+// This file is part of Proxy.
+
+// Proxy is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General
+// Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your
+// option) any later version.
+
+// Proxy is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the
+// implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU Lesser General Public
+// License for more details.
+
+// You should have received a copy of the GNU Lesser General
+// Public License along with Proxy.  If not, see
+// <https://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+
+	gp "golang.org/x/net/proxy"
+)
+
+// socks4Proxy is a SOCKS4 or SOCKS4a proxy. With the former
+// host names are resolved locally, since the protocol only
+// supports IPv4 addresses
+type socks4Proxy struct {
+	host    string
+	userID  string
+	remote  bool
+	forward gp.Dialer
+}
+
+func newSOCKS4Proxy(uri *url.URL,
+	forward gp.Dialer) (dlr gp.Dialer, e error) {
+	s := &socks4Proxy{
+		host:    hostWithPort(uri.Host, ":1080"),
+		forward: forward,
+	}
+	if uri.User != nil {
+		s.userID = uri.User.Username()
+	}
+	dlr = s
+	return
+}
+
+func newSOCKS4aProxy(uri *url.URL,
+	forward gp.Dialer) (dlr gp.Dialer, e error) {
+	dlr, e = newSOCKS4Proxy(uri, forward)
+	if e == nil {
+		dlr.(*socks4Proxy).remote = true
+	}
+	return
+}
+
+func (s *socks4Proxy) Dial(network, addr string) (n net.Conn,
+	e error) {
+	n, e = s.DialContext(context.Background(), network, addr)
+	return
+}
+
+const (
+	socks4Version   = 4
+	socks4Connect   = 1
+	socks4Granted   = 90
+	socks4Rejected  = 91
+	socks4NoIdentd  = 92
+	socks4BadUserID = 93
+)
+
+// DialContext connects to addr through the proxy, returning
+// *SOCKS4RejectedErr, *SOCKS4NoIdentdErr or
+// *SOCKS4UserIDErr when it refuses
+func (s *socks4Proxy) DialContext(ctx context.Context, network,
+	addr string) (n net.Conn, e error) {
+	if network != "tcp" && network != "tcp4" {
+		e = fmt.Errorf("Network '%s' not supported by SOCKS4",
+			network)
+	}
+	var req []byte
+	if e == nil {
+		req, e = s.request(ctx, addr)
+	}
+	var c net.Conn
+	if e == nil {
+		c, e = dialContext(ctx, s.forward, tcp, s.host)
+	}
+	if e == nil {
+		stop := watchContext(ctx, c)
+		_, e = c.Write(req)
+		reply := make([]byte, 8)
+		if e == nil {
+			_, e = io.ReadFull(c, reply)
+		}
+		if e == nil {
+			e = socks4ReplyErr(reply, addr)
+		}
+		if ce := stop(); ce != nil {
+			e = ce
+		}
+		if e == nil {
+			n = c
+		} else {
+			c.Close()
+		}
+	}
+	return
+}
+
+// request returns the CONNECT request for addr
+func (s *socks4Proxy) request(ctx context.Context,
+	addr string) (req []byte, e error) {
+	host, sport, e := net.SplitHostPort(addr)
+	var port uint64
+	if e == nil {
+		port, e = strconv.ParseUint(sport, 10, 16)
+	}
+	ip := net.ParseIP(host).To4()
+	if e == nil && ip == nil && !s.remote {
+		ip, e = lookupIPv4(ctx, host)
+	}
+	if e == nil {
+		req = []byte{socks4Version, socks4Connect, 0, 0}
+		binary.BigEndian.PutUint16(req[2:], uint16(port))
+		if ip == nil {
+			// SOCKS4a: an invalid IP 0.0.0.x with x != 0 makes the
+			// proxy read the host name after the user ID
+			req = append(req, 0, 0, 0, 1)
+		} else {
+			req = append(req, ip...)
+		}
+		req = append(append(req, s.userID...), 0)
+		if ip == nil {
+			req = append(append(req, host...), 0)
+		}
+	}
+	return
+}
+
+func lookupIPv4(ctx context.Context, host string) (ip net.IP,
+	e error) {
+	var addrs []net.IPAddr
+	addrs, e = net.DefaultResolver.LookupIPAddr(ctx, host)
+	for i := 0; e == nil && ip == nil && i != len(addrs); i++ {
+		ip = addrs[i].IP.To4()
+	}
+	if e == nil && ip == nil {
+		e = fmt.Errorf("No IPv4 address for '%s'", host)
+	}
+	return
+}
+
+func socks4ReplyErr(reply []byte, addr string) (e error) {
+	switch {
+	case reply[0] != 0:
+		e = fmt.Errorf("Unexpected SOCKS4 reply version %d",
+			reply[0])
+	case reply[1] == socks4Granted:
+	case reply[1] == socks4NoIdentd:
+		e = &SOCKS4NoIdentdErr{Addr: addr}
+	case reply[1] == socks4BadUserID:
+		e = &SOCKS4UserIDErr{Addr: addr}
+	default:
+		e = &SOCKS4RejectedErr{Addr: addr, Code: reply[1]}
+	}
+	return
+}
+
+// SOCKS4RejectedErr is returned when a SOCKS4 proxy rejects
+// or fails connecting to Addr. Code is the one in its reply,
+// usually 91
+type SOCKS4RejectedErr struct {
+	Addr string
+	Code byte
+}
+
+func (e *SOCKS4RejectedErr) Error() (s string) {
+	s = fmt.Sprintf("SOCKS4 request for '%s' rejected or failed "+
+		"(code %d)", e.Addr, e.Code)
+	return
+}
+
+// SOCKS4NoIdentdErr is returned when a SOCKS4 proxy rejects
+// the request because it cannot connect to the client's identd
+type SOCKS4NoIdentdErr struct {
+	Addr string
+}
+
+func (e *SOCKS4NoIdentdErr) Error() (s string) {
+	s = fmt.Sprintf("SOCKS4 request for '%s' rejected: proxy "+
+		"cannot connect to identd", e.Addr)
+	return
+}
+
+// SOCKS4UserIDErr is returned when a SOCKS4 proxy rejects the
+// request because the user ID doesn't match the reported by
+// the client's identd
+type SOCKS4UserIDErr struct {
+	Addr string
+}
+
+func (e *SOCKS4UserIDErr) Error() (s string) {
+	s = fmt.Sprintf("SOCKS4 request for '%s' rejected: user ID "+
+		"mismatch with identd", e.Addr)
+	return
+}
@@ -21,20 +21,54 @@
 package proxy
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"io"
+	"log"
 	"net"
 	h "net/http"
 	"sync"
-
-	fh "github.com/valyala/fasthttp"
-	gp "golang.org/x/net/proxy"
+	"time"
 )
 
 type Proxy struct {
+	// MITM, when not nil, intercepts the CONNECT tunnels it
+	// matches. Only the net/http front end supports it
+	MITM *MITM
+	// Headers, when not nil, replaces the default policy of
+	// adding Via and X-Forwarded-For
+	Headers *HeaderPolicy
+	// Pool, when not nil, keeps the connections to
+	// destinations separated by the keys it assigns to
+	// requests. Otherwise they are shared by all of them.
+	// Only the net/http front end uses it
+	Pool *TransportPool
+	// Cache, when not nil and with a Policy, answers the plain
+	// HTTP requests it can with stored responses. Only the
+	// net/http front end uses it
+	Cache *Cache
+	// Log, when not nil, gets a line for each plain HTTP
+	// request forwarded
+	Log *log.Logger
+	// Middlewares inspect and modify the forwarded requests
+	// and their responses
+	Middlewares []*Middleware
+	// Limits, when not nil, bounds the sizes of the bodies of
+	// the plain HTTP requests and responses
+	Limits *BodyLimits
+	// FastStream makes the fasthttp front end send the response
+	// bodies while reading them from the destination, instead of
+	// buffering them. Request bodies are streamed when the
+	// fasthttp.Server has StreamRequestBody
+	FastStream bool
+
 	trans       *h.Transport
-	fastCl      *fh.Client
+	fastPool    *fastPool
 	dialContext Dialer
+	// defaultHeaders is used when Headers is nil
+	defaultHeaders *HeaderPolicy
+	headersOnce    sync.Once
 }
 
 // NewProxy creates a net/http.Handler ready to be used
@@ -46,7 +80,7 @@ func NewProxy(dial Dialer) (p *Proxy) {
 		trans:       new(h.Transport),
 	}
 	p.trans.DialContext = p.dialContext
-	gp.RegisterDialerType("http", newHTTPProxy)
+	registerDialers()
 	return
 }
 
@@ -61,17 +95,45 @@ type ReqParams struct {
 	Method string
 	IP     string
 	URL    string
+	// User is the name of the authenticated client, empty
+	// when the front end doesn't know it
+	User string
+	// Protocol is the one bootstrapped by an extended CONNECT
+	// request, like websocket or connect-udp
+	Protocol string
 }
 
 func (p *Proxy) ServeHTTP(w h.ResponseWriter,
 	r *h.Request) {
-	i := &ReqParams{Method: r.Method, URL: r.URL.Host}
+	if r.ProtoMajor >= 2 && r.URL.Host == "" {
+		// HTTP/2 and HTTP/3 requests carry the destination in
+		// :authority, and the clients of a proxy only send http
+		// as :scheme
+		r.URL.Scheme, r.URL.Host = "http", r.Host
+	}
+	protocol := r.Header.Get(":protocol")
+	i := &ReqParams{
+		Method:   r.Method,
+		URL:      r.URL.Host,
+		User:     clientUser(r.TLS),
+		Protocol: protocol,
+	}
 	var e error
 	i.IP, _, e = net.SplitHostPort(r.RemoteAddr)
 	if e == nil {
 		c := context.WithValue(r.Context(), ReqParamsK, i)
 		nr := r.WithContext(c)
-		if r.Method == h.MethodConnect {
+		if r.Method == h.MethodConnect && r.ProtoMajor == 2 &&
+			!streamDeadlines {
+			// the server timeouts would end the tunnels
+			h.Error(w, noStreamDeadlines().Error(),
+				h.StatusNotImplemented)
+		} else if r.Method == h.MethodConnect &&
+			protocol == "connect-udp" {
+			p.handleConnectUDP(w, nr)
+		} else if r.Method == h.MethodConnect && protocol != "" {
+			p.handleExtendedConnect(w, nr, protocol)
+		} else if r.Method == h.MethodConnect {
 			p.handleTunneling(w, nr)
 		} else {
 			p.handleHTTP(w, nr)
@@ -84,29 +146,31 @@ func (p *Proxy) ServeHTTP(w h.ResponseWriter,
 
 func (p *Proxy) handleTunneling(w h.ResponseWriter,
 	r *h.Request) {
-	destConn, e := p.dialContext(r.Context(), "tcp", r.Host)
-	var hijacker h.Hijacker
-	status := h.StatusOK
-	if e == nil {
-		w.WriteHeader(status)
-		var ok bool
-		hijacker, ok = w.(h.Hijacker)
-		if !ok {
-			e = noHijacking()
-		}
-	} else {
-		status = h.StatusServiceUnavailable
+	rqp, _ := r.Context().Value(ReqParamsK).(*ReqParams)
+	ms := middlewares(p.Middlewares)
+	if e := ms.connect(rqp); e != nil {
+		h.Error(w, e.Error(), errStatus(e, h.StatusForbidden))
+		return
+	}
+	if p.MITM != nil && p.MITM.Intercepts(r.URL.Hostname()) {
+		p.handleIntercepted(w, r)
+		return
 	}
+	destConn, e := p.dialContext(r.Context(), "tcp", r.Host)
+	status := h.StatusServiceUnavailable
 	var clientConn net.Conn
 	if e == nil {
-		clientConn, _, e = hijacker.Hijack()
-	} else {
-		status = h.StatusInternalServerError
+		clientConn, e = tunnelClient(w, r)
+		if e != nil {
+			destConn.Close()
+			status = h.StatusInternalServerError
+		}
 	}
-	if e == nil {
+	if sc, ok := clientConn.(*streamConn); ok && e == nil {
+		// the stream ends when the handler returns
+		sc.relay(destConn)
+	} else if e == nil {
 		copyConns(destConn, clientConn)
-	} else {
-		status = h.StatusServiceUnavailable
 	}
 
 	if e != nil {
@@ -114,19 +178,210 @@ func (p *Proxy) handleTunneling(w h.ResponseWriter,
 	}
 }
 
+// handleIntercepted answers the CONNECT request r and
+// serves the connection with p.MITM, dialing later for each
+// request made through it
+func (p *Proxy) handleIntercepted(w h.ResponseWriter,
+	r *h.Request) {
+	clientConn, e := tunnelClient(w, r)
+	if e == nil {
+		go p.serveMITM(clientConn, r)
+		if sc, ok := clientConn.(*streamConn); ok {
+			sc.wait()
+		}
+	} else {
+		h.Error(w, e.Error(), h.StatusInternalServerError)
+	}
+}
+
 func (p *Proxy) handleHTTP(w h.ResponseWriter,
 	req *h.Request) {
-	resp, e := p.trans.RoundTrip(req)
+	p.handleHTTPWith(w, req, p.trans, p.Cache)
+}
+
+// handleHTTPWith forwards r using base, or the transport
+// like it in p.Pool for r. When cache isn't nil it's used for
+// answering r
+func (p *Proxy) handleHTTPWith(w h.ResponseWriter,
+	r *h.Request, base *h.Transport, cache *Cache) {
+	start := time.Now()
+	// the server still reads the headers of r, for deciding
+	// whether the client connection persists
+	req := r.Clone(r.Context())
+	if _, ok := req.Header["User-Agent"]; !ok {
+		// keeps the transport from adding its own
+		req.Header.Set("User-Agent", "")
+	}
+	upgrade := isUpgrade(req.Header["Connection"],
+		req.Header.Get("Upgrade"))
+	rqp, _ := req.Context().Value(ReqParamsK).(*ReqParams)
+	var ip string
+	trans := base
+	if rqp != nil {
+		ip = rqp.IP
+		if p.Pool != nil {
+			trans = p.Pool.transport(base, rqp)
+		}
+	}
+	hp := p.headerPolicy()
+	loop := hp.forwardRequest(stdHeader(req.Header), upgrade,
+		stdVersion(req.ProtoMajor, req.ProtoMinor), ip)
+	if loop {
+		h.Error(w, loopDetected().Error(), h.StatusLoopDetected)
+		return
+	}
+	// the client connection persistence is independent of
+	// the one with the destination
+	req.Close = false
+	reqLimit, respLimit := p.Limits.limits(rqp)
+	var e error
+	if reqLimit != 0 && req.ContentLength > reqLimit {
+		e = bodyTooLarge(reqLimit, false)
+	} else if reqLimit != 0 && req.ContentLength == -1 {
+		req.Body = &limitedBody{
+			ReadCloser: req.Body,
+			n:          reqLimit,
+			err:        bodyTooLarge(reqLimit, false),
+		}
+	}
+	ms := middlewares(p.Middlewares)
+	var resp *h.Response
+	var n int
+	if e == nil {
+		resp, n, e = ms.request(req)
+	}
+	if e == nil && rqp != nil {
+		// the dialer decides about the destination the
+		// middlewares set
+		rqp.URL = req.URL.Host
+	}
+	var cacheStatus string
+	status := h.StatusForbidden
+	if e == nil && resp == nil {
+		status = h.StatusServiceUnavailable
+		if cache != nil && cache.Policy != nil && !upgrade {
+			resp, cacheStatus, e = cache.roundTrip(trans, req,
+				func() error { return cache.allow(rqp) })
+		} else {
+			resp, e = trans.RoundTrip(req)
+		}
+		if e == nil && resp.StatusCode != h.StatusSwitchingProtocols {
+			hp.forwardResponse(stdHeader(resp.Header), false,
+				stdVersion(resp.ProtoMajor, resp.ProtoMinor))
+		}
+		if e == nil && cacheStatus != "" {
+			resp.Header.Set("X-Cache", cacheStatus)
+		}
+	}
+	if e == nil {
+		status = h.StatusBadGateway
+		e = ms.response(resp, n)
+		if e == nil && respLimit != 0 && resp.ContentLength > respLimit {
+			e = bodyTooLarge(respLimit, true)
+		}
+		if e != nil {
+			resp.Body.Close()
+		}
+	}
 	if e == nil {
+		status = resp.StatusCode
+	} else {
+		status = errStatus(e, status)
+	}
+	// cut means the response was cut off, and the client must
+	// not take it as complete
+	var cut bool
+	if e == nil && resp.StatusCode == h.StatusSwitchingProtocols {
+		switchProtocols(w, resp, hp)
+	} else if e == nil {
+		if respLimit != 0 {
+			resp.Body = &limitedBody{
+				ReadCloser: resp.Body,
+				n:          respLimit,
+				err:        &BodyLimitErr{Limit: respLimit, Response: true},
+			}
+		}
 		copyHeader(w.Header(), resp.Header)
 		w.WriteHeader(resp.StatusCode)
 		_, e = io.Copy(w, resp.Body)
 		resp.Body.Close()
+		var le *BodyLimitErr
+		cut = errors.As(e, &le)
+	} else {
+		h.Error(w, e.Error(), status)
+	}
+	p.logRequest(ip, req.Method, req.URL.String(), status,
+		cacheStatus, start, e)
+	if cut {
+		panic(h.ErrAbortHandler)
+	}
+}
+
+// switchProtocols sends resp, a 101 response to an upgrade
+// request, to the client and relays the connection afterwards
+func switchProtocols(w h.ResponseWriter, resp *h.Response,
+	hp *HeaderPolicy) {
+	dest, ok := resp.Body.(io.ReadWriteCloser)
+	hijacker, hok := w.(h.Hijacker)
+	var e error
+	if !ok || !hok {
+		e = noHijacking()
+	}
+	var client net.Conn
+	var rw *bufio.ReadWriter
+	if e == nil {
+		client, rw, e = hijacker.Hijack()
+	}
+	if e == nil {
+		// the server deadlines would interrupt the relay
+		client.SetDeadline(time.Time{})
+		hp.forwardResponse(stdHeader(resp.Header), true,
+			stdVersion(resp.ProtoMajor, resp.ProtoMinor))
+		rw.WriteString("HTTP/1.1 " + resp.Status + "\r\n")
+		resp.Header.Write(rw)
+		rw.WriteString("\r\n")
+		e = rw.Flush()
+	}
+	if e == nil {
+		transWait(dest, &peekedConn{Conn: client, r: rw.Reader})
 	} else {
-		h.Error(w, e.Error(), h.StatusServiceUnavailable)
+		resp.Body.Close()
+		if client != nil {
+			client.Close()
+		} else {
+			h.Error(w, e.Error(), h.StatusInternalServerError)
+		}
 	}
 }
 
+// logRequest writes to p.Log, when not nil, a line for a
+// forwarded request, with the error e as reason when not nil
+func (p *Proxy) logRequest(ip, method, url string, status int,
+	cacheStatus string, start time.Time, e error) {
+	if p.Log != nil {
+		if cacheStatus == "" {
+			cacheStatus = "-"
+		}
+		var reason string
+		if e != nil {
+			reason = " " + e.Error()
+		}
+		p.Log.Printf("%s %s %s %d %s %s%s", ip, method, url, status,
+			cacheStatus, time.Since(start), reason)
+	}
+}
+
+func (p *Proxy) headerPolicy() (hp *HeaderPolicy) {
+	hp = p.Headers
+	if hp == nil {
+		p.headersOnce.Do(func() {
+			p.defaultHeaders = &HeaderPolicy{XForwardedFor: true}
+		})
+		hp = p.defaultHeaders
+	}
+	return
+}
+
 func transfer(dest io.WriteCloser, src io.ReadCloser) {
 	io.Copy(dest, src)
 	dest.Close()
@@ -135,11 +390,8 @@ func transfer(dest io.WriteCloser, src io.ReadCloser) {
 
 func copyHeader(dst, src h.Header) {
 	for k, vv := range src {
-		ok := searchHopByHop(k)
-		if !ok {
-			for _, v := range vv {
-				dst.Add(k, v)
-			}
+		for _, v := range vv {
+			dst.Add(k, v)
 		}
 	}
 }
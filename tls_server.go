@@ -0,0 +1,115 @@
+// Copyright © 2018-2019 Luis Ángel Méndez Gort
+
+// This file is part of Proxy.
+
+// Proxy is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General
+// Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your
+// option) any later version.
+
+// Proxy is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the
+// implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU Lesser General Public
+// License for more details.
+
+// You should have received a copy of the GNU Lesser General
+// Public License along with Proxy.  If not, see
+// <https://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// CertReloader holds a certificate loaded from PEM files,
+// that can be reloaded while serving, for example when it
+// is renewed
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	mtx      sync.RWMutex
+	cert     *tls.Certificate
+}
+
+// NewCertReloader loads the certificate and key in the
+// supplied files
+func NewCertReloader(certFile, keyFile string) (r *CertReloader,
+	e error) {
+	r = &CertReloader{certFile: certFile, keyFile: keyFile}
+	e = r.Reload()
+	return
+}
+
+// Reload loads again the certificate files. The previous
+// certificate is kept if they cannot be loaded
+func (r *CertReloader) Reload() (e error) {
+	var cert tls.Certificate
+	cert, e = tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if e == nil {
+		r.mtx.Lock()
+		r.cert = &cert
+		r.mtx.Unlock()
+	}
+	return
+}
+
+// ReloadOnSIGHUP reloads the certificate each time the
+// process receives SIGHUP, calling onError, when not nil,
+// with the errors found
+func (r *CertReloader) ReloadOnSIGHUP(onError func(error)) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	go func() {
+		for range sig {
+			e := r.Reload()
+			if e != nil && onError != nil {
+				onError(e)
+			}
+		}
+	}()
+}
+
+// GetCertificate returns the last loaded certificate, and can
+// be used as tls.Config.GetCertificate
+func (r *CertReloader) GetCertificate(
+	hello *tls.ClientHelloInfo) (c *tls.Certificate, e error) {
+	r.mtx.RLock()
+	c = r.cert
+	r.mtx.RUnlock()
+	return
+}
+
+// NewTLSConfig creates a *tls.Config for serving the proxy
+// over TLS, with the certificate held by r. When clientCAs
+// isn't nil, clients must present a certificate signed by
+// them, and the common name in its subject becomes
+// ReqParams.User
+func NewTLSConfig(r *CertReloader,
+	clientCAs *x509.CertPool) (c *tls.Config) {
+	c = &tls.Config{
+		GetCertificate: r.GetCertificate,
+		NextProtos:     []string{"http/1.1"},
+	}
+	if clientCAs != nil {
+		c.ClientCAs = clientCAs
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return
+}
+
+// clientUser returns the common name of the verified client
+// certificate, if any
+func clientUser(st *tls.ConnectionState) (user string) {
+	if st != nil && len(st.VerifiedChains) != 0 {
+		user = st.VerifiedChains[0][0].Subject.CommonName
+	}
+	return
+}
@@ -0,0 +1,130 @@
+// Copyright © 2018-2019 Luis Ángel Méndez Gort
+
+// This file is part of Proxy.
+
+// Proxy is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General
+// Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your
+// option) any later version.
+
+// Proxy is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the
+// implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU Lesser General Public
+// License for more details.
+
+// You should have received a copy of the GNU Lesser General
+// Public License along with Proxy.  If not, see
+// <https://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"time"
+)
+
+// sniffTimeout bounds the time waiting for the client to send
+// the ClientHello or request headers. Protocols where the server
+// speaks first are relayed once it expires
+const sniffTimeout = 5 * time.Second
+
+// ServeTransparent accepts connections redirected to l by
+// iptables REDIRECT, recovers their original destination and
+// relays them through the Dialer. ReqParams.URL has the HTTP
+// Host header or the TLS server name, when present, and the
+// original destination otherwise. Only supported on Linux
+func (p *Proxy) ServeTransparent(l net.Listener) (e error) {
+	for e == nil {
+		var c net.Conn
+		c, e = l.Accept()
+		if e == nil {
+			go p.serveTransparent(c)
+		}
+	}
+	return
+}
+
+func (p *Proxy) serveTransparent(client net.Conn) {
+	dst, e := originalDst(client)
+	if e == nil {
+		p.relaySniffed(client, dst)
+	} else {
+		client.Close()
+	}
+}
+
+// relaySniffed sniffs the client connection to build the
+// ReqParams for the dialer, and relays it to addr. Connections
+// whose sniffing fails are relayed with addr as URL, and the
+// ones to the proxy itself are closed, since they weren't
+// redirected
+func (p *Proxy) relaySniffed(client net.Conn, addr string) {
+	if addr != localAddr(client) {
+		br := bufio.NewReaderSize(client, maxHelloSize)
+		client.SetReadDeadline(time.Now().Add(sniffTimeout))
+		method, host, e := sniff(br)
+		client.SetReadDeadline(time.Time{})
+		i := &ReqParams{
+			Method: method,
+			URL:    hostWithPort(host, addr),
+			IP:     remoteIP(client),
+		}
+		if e != nil {
+			// timeouts are of protocols where the server speaks
+			// first, and the rest of unknown or malformed ones
+			i.URL = addr
+		}
+		p.relayPeeked(client, br, i, addr)
+	} else {
+		client.Close()
+	}
+}
+
+// relayPeeked dials addr with i in the context, when the
+// middlewares allow it, and relays the client connection,
+// whose first bytes are in br
+func (p *Proxy) relayPeeked(client net.Conn, br *bufio.Reader,
+	i *ReqParams, addr string) {
+	e := middlewares(p.Middlewares).connect(i)
+	var dest net.Conn
+	if e == nil {
+		ctx := context.WithValue(context.Background(), ReqParamsK, i)
+		dest, e = p.dialContext(ctx, tcp, addr)
+	}
+	if e == nil {
+		copyConns(dest, &peekedConn{Conn: client, r: br})
+	} else {
+		client.Close()
+	}
+}
+
+// remoteIP returns the IP address of the remote end of c
+func remoteIP(c net.Conn) (ip string) {
+	if a := c.RemoteAddr(); a != nil {
+		ip, _, _ = net.SplitHostPort(a.String())
+	}
+	return
+}
+
+// localAddr returns the address of the local end of c
+func localAddr(c net.Conn) (addr string) {
+	if a := c.LocalAddr(); a != nil {
+		addr = a.String()
+	}
+	return
+}
+
+// peekedConn reads first the bytes peeked from the connection
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (n int, e error) {
+	n, e = c.r.Read(p)
+	return
+}
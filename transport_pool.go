@@ -0,0 +1,139 @@
+// Copyright © 2018-2019 Luis Ángel Méndez Gort
+
+// This file is part of Proxy.
+
+// Proxy is free software: you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General
+// Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your
+// option) any later version.
+
+// Proxy is distributed in the hope that it will be
+// useful, but WITHOUT ANY WARRANTY; without even the
+// implied warranty of MERCHANTABILITY or FITNESS FOR A
+// PARTICULAR PURPOSE. See the GNU Lesser General Public
+// License for more details.
+
+// You should have received a copy of the GNU Lesser General
+// Public License along with Proxy.  If not, see
+// <https://www.gnu.org/licenses/>.
+
+package proxy
+
+import (
+	"container/list"
+	h "net/http"
+	"sync"
+	"time"
+)
+
+// TransportPool keeps a net/http.Transport for each key
+// returned by Key, so connections dialed for a request are
+// reused only by requests with the same key
+type TransportPool struct {
+	// Key returns the key for the parameters of a request,
+	// like the network interface or the parent proxy the
+	// dialer chooses for it
+	Key func(*ReqParams) string
+	// MaxTransports, when not zero, bounds the number of
+	// transports, removing the least recently used
+	MaxTransports int
+	// MaxIdleConnsPerHost and MaxConnsPerHost, when not zero,
+	// bound the connections of each transport to a host
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int
+	// IdleTimeout, when not zero, closes connections idle for
+	// that time, and removes the transports unused for that
+	// time. By default it is 90 seconds
+	IdleTimeout time.Duration
+
+	mtx sync.Mutex
+	// lru has the *poolEntry values, the most recently used
+	// at front
+	lru     *list.List
+	entries map[poolKey]*list.Element
+	now     func() time.Time
+}
+
+// poolKey distinguishes the transports derived from different
+// bases, like the one used when intercepting TLS
+type poolKey struct {
+	base *h.Transport
+	key  string
+}
+
+type poolEntry struct {
+	key   poolKey
+	trans *h.Transport
+	used  time.Time
+}
+
+func (p *TransportPool) idleTimeout() (d time.Duration) {
+	d = p.IdleTimeout
+	if d == 0 {
+		d = 90 * time.Second
+	}
+	return
+}
+
+// transport returns the transport like base for the key of
+// rqp, creating it if needed
+func (p *TransportPool) transport(base *h.Transport,
+	rqp *ReqParams) (t *h.Transport) {
+	now := time.Now
+	if p.now != nil {
+		now = p.now
+	}
+	k := poolKey{base: base, key: p.Key(rqp)}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.entries == nil {
+		p.lru, p.entries = list.New(), make(map[poolKey]*list.Element)
+	}
+	t0 := now()
+	el, ok := p.entries[k]
+	if ok {
+		p.lru.MoveToFront(el)
+	} else {
+		t := base.Clone()
+		t.IdleConnTimeout = p.idleTimeout()
+		if p.MaxIdleConnsPerHost != 0 {
+			t.MaxIdleConnsPerHost = p.MaxIdleConnsPerHost
+		}
+		if p.MaxConnsPerHost != 0 {
+			t.MaxConnsPerHost = p.MaxConnsPerHost
+		}
+		el = p.lru.PushFront(&poolEntry{key: k, trans: t})
+		p.entries[k] = el
+	}
+	ent := el.Value.(*poolEntry)
+	ent.used = t0
+	p.evict(t0)
+	t = ent.trans
+	return
+}
+
+// evict removes the transports exceeding MaxTransports, and
+// those unused for IdleTimeout, closing their idle
+// connections. Requests using them continue
+func (p *TransportPool) evict(now time.Time) {
+	for back := p.lru.Back(); back != nil; back = p.lru.Back() {
+		ent := back.Value.(*poolEntry)
+		exceeds := p.MaxTransports != 0 &&
+			p.lru.Len() > p.MaxTransports
+		if !exceeds && now.Sub(ent.used) < p.idleTimeout() {
+			break
+		}
+		p.lru.Remove(back)
+		delete(p.entries, ent.key)
+		ent.trans.CloseIdleConnections()
+	}
+}
+
+// Len returns the number of transports in the pool
+func (p *TransportPool) Len() (n int) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	n = len(p.entries)
+	return
+}